@@ -0,0 +1,166 @@
+// Package admin exposes an authenticated HTTP API for operating a running gateway
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spec-tacles/gateway/config"
+	"github.com/spec-tacles/gateway/gateway"
+	"github.com/spec-tacles/go/types"
+)
+
+// Prefix is the path under which the admin API is served
+const Prefix = "/admin/"
+
+// Server serves the admin API for a manager
+type Server struct {
+	Manager *gateway.Manager
+	Config  *config.Config
+	Token   string
+}
+
+// ShardInfo describes a shard in the admin API
+type ShardInfo struct {
+	ID        int                `json:"id"`
+	State     gateway.ShardState `json:"state"`
+	Ping      float64            `json:"ping"`
+	Seq       uint64             `json:"seq"`
+	SessionID string             `json:"session_id"`
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "shards":
+		s.allow(w, r, http.MethodGet, s.listShards)
+	case len(path) == 3 && path[0] == "shards":
+		id, err := strconv.Atoi(path[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s.allow(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			s.shardAction(w, r, id, path[2])
+		})
+	case len(path) == 1 && path[0] == "presence":
+		s.allow(w, r, http.MethodPost, s.updatePresence)
+	case len(path) == 1 && path[0] == "config":
+		s.allow(w, r, http.MethodGet, s.dumpConfig)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// authorized checks the request's bearer token
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// allow calls the handler if the request uses the given method
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, method string, handler http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	handler(w, r)
+}
+
+func (s *Server) listShards(w http.ResponseWriter, r *http.Request) {
+	statuses := s.Manager.ShardStatuses()
+	shards := make([]ShardInfo, 0, len(statuses))
+	for id := range statuses {
+		shard := s.Manager.Shard(id)
+		if shard == nil {
+			continue
+		}
+
+		shards = append(shards, ShardInfo{
+			ID:        id,
+			State:     shard.Status(),
+			Ping:      float64(shard.Ping().Nanoseconds()) / 1e6,
+			Seq:       shard.Seq(),
+			SessionID: shard.SessionID(),
+		})
+	}
+
+	sort.Slice(shards, func(i, j int) bool { return shards[i].ID < shards[j].ID })
+	writeJSON(w, http.StatusOK, shards)
+}
+
+func (s *Server) shardAction(w http.ResponseWriter, r *http.Request, id int, action string) {
+	var err error
+	if action == "restart" {
+		err = s.Manager.RestartShard(id)
+	} else {
+		shard := s.Manager.Shard(id)
+		if shard == nil {
+			writeError(w, http.StatusNotFound, gateway.ErrShardNotFound)
+			return
+		}
+
+		switch action {
+		case "reconnect":
+			err = shard.Reconnect()
+		case "reidentify":
+			err = shard.Reidentify(r.Context())
+		default:
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, gateway.ErrShardNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusConflict, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) updatePresence(w http.ResponseWriter, r *http.Request) {
+	presence := new(types.StatusUpdate)
+	if err := json.NewDecoder(r.Body).Decode(presence); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.Manager.UpdatePresence(presence); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) dumpConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Config.Redacted())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
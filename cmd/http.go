@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spec-tacles/gateway/admin"
+	"github.com/spec-tacles/gateway/config"
+	"github.com/spec-tacles/gateway/gateway"
+	"github.com/spec-tacles/gateway/health"
+)
+
+// serveHTTP starts HTTP servers for Prometheus stats, health checks and the admin API. Handlers
+// configured with the same address share a server.
+func serveHTTP(conf *config.Config, manager *gateway.Manager) {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(address string) *http.ServeMux {
+		if m, ok := muxes[address]; ok {
+			return m
+		}
+
+		m := http.NewServeMux()
+		muxes[address] = m
+		return m
+	}
+
+	if conf.Prometheus.Address != "" {
+		endpoint := conf.Prometheus.Endpoint
+		if endpoint == "" {
+			endpoint = "/"
+		}
+
+		logger.Printf("exposing Prometheus stats at %v%v", conf.Prometheus.Address, conf.Prometheus.Endpoint)
+		mux(conf.Prometheus.Address).Handle(endpoint, promhttp.Handler())
+	}
+
+	healthAddress := conf.Health.Address
+	if healthAddress == "" {
+		healthAddress = conf.Prometheus.Address
+	}
+
+	if healthAddress != "" {
+		logger.Printf("exposing health checks at %v%v and %v", healthAddress, health.LivenessEndpoint, health.ReadinessEndpoint)
+		(&health.Handler{
+			Manager:  manager,
+			MinReady: *conf.Health.MinReady,
+		}).Register(mux(healthAddress))
+	}
+
+	adminAddress := conf.Admin.Address
+	if adminAddress == "" {
+		adminAddress = conf.Prometheus.Address
+	}
+
+	switch {
+	case conf.Admin.Token == "":
+		if conf.Admin.Address != "" {
+			logger.Printf("admin API disabled: no token configured")
+		}
+	case adminAddress == "":
+		logger.Printf("admin API disabled: no address configured")
+	default:
+		logger.Printf("exposing admin API at %v%v", adminAddress, admin.Prefix)
+		mux(adminAddress).Handle(admin.Prefix, &admin.Server{
+			Manager: manager,
+			Config:  conf,
+			Token:   conf.Admin.Token,
+		})
+	}
+
+	for address, m := range muxes {
+		go func(address string, m *http.ServeMux) {
+			logger.Fatal(http.ListenAndServe(address, m))
+		}(address, m)
+	}
+}
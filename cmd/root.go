@@ -3,12 +3,13 @@ package cmd
 import (
 	"context"
 	"flag"
-	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/mediocregopher/radix/v4"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rabbitmq/amqp091-go"
 	"github.com/spec-tacles/gateway/config"
 	"github.com/spec-tacles/gateway/gateway"
@@ -73,28 +74,27 @@ func Run() {
 		logger.Fatalf("unable to load config: %s\n", err)
 	}
 
-	if conf.Prometheus.Address != "" {
-		var mainHandler http.Handler
-		if conf.Prometheus.Endpoint == "" {
-			mainHandler = promhttp.Handler()
-		} else {
-			http.Handle(conf.Prometheus.Endpoint, promhttp.Handler())
-		}
-
-		logger.Printf("exposing Prometheus stats at %v%v", conf.Prometheus.Address, conf.Prometheus.Endpoint)
-		go func() {
-			logger.Fatal(http.ListenAndServe(conf.Prometheus.Address, mainHandler))
-		}()
-	}
-
 	var (
-		manager    *gateway.Manager
-		b          broker.Broker
-		shardStore gateway.ShardStore
-		logLevel   = logLevels[*logLevel]
-		ctx        = context.Background()
+		manager          *gateway.Manager
+		b                broker.Broker
+		shardStore       gateway.ShardStore
+		shardCoordinator gateway.ShardCoordinator
+		logLevel         = logLevels[*logLevel]
 	)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		stop()
+
+		logger.Printf("shutting down (timeout %s)", conf.ShutdownTimeout)
+		time.AfterFunc(conf.ShutdownTimeout.Duration, func() {
+			logger.Fatalf("timed out while shutting down")
+		})
+	}()
+
 	switch conf.Broker.Type {
 	case "amqp":
 		conn, err := amqp091.Dial(conf.AMQP.URL)
@@ -122,8 +122,18 @@ func Run() {
 	case "redis":
 		redis := getRedis(ctx, conf)
 		shardStore = &gateway.RedisShardStore{
-			Redis:  redis,
-			Prefix: conf.ShardStore.Prefix,
+			Redis:      redis,
+			Prefix:     conf.ShardStore.Prefix,
+			SessionTTL: conf.ShardStore.SessionTTL.Duration,
+		}
+	}
+
+	switch conf.ShardCoordinator.Type {
+	case "redis":
+		shardCoordinator = &gateway.RedisShardCoordinator{
+			Redis:    getRedis(ctx, conf),
+			Prefix:   conf.ShardCoordinator.Prefix,
+			LeaseTTL: conf.ShardCoordinator.LeaseTTL.Duration,
 		}
 	}
 
@@ -139,13 +149,35 @@ func Run() {
 				Intents:  int(conf.RawIntents),
 				Presence: &conf.Presence,
 			},
-			Version: conf.GatewayVersion,
+			Version:            conf.GatewayVersion,
+			Compression:        conf.Compression,
+			Encoding:           conf.Encoding,
+			RawETF:             conf.RawETF,
+			SuppressDuplicates: conf.Shards.SuppressDuplicates,
+			SessionTTL:         conf.ShardStore.SessionTTL.Duration,
 		},
-		REST:       r,
-		LogLevel:   logLevel,
-		ShardCount: conf.Shards.Count,
+		REST:                r,
+		LogLevel:            logLevel,
+		ShardCount:          conf.Shards.Count,
+		ShardIDs:            conf.Shards.IDs,
+		ServerIndex:         conf.Shards.ServerIndex,
+		ServerCount:         conf.Shards.ServerCount,
+		SessionStartReserve: conf.Shards.SessionStartReserve,
+		ShardCoordinator:    shardCoordinator,
+		ReshardInterval:     conf.Shards.ReshardInterval.Duration,
+		Envelope:            conf.Broker.Envelope,
+		InstanceID:          conf.Broker.InstanceID,
+		PartitionKey:        conf.Broker.PartitionKey,
+		Partitions:          conf.Broker.Partitions,
+		PublishWorkers:      conf.Broker.PublishWorkers,
+		PublishQueueSize:    conf.Broker.QueueSize,
+		PublishOverflow:     conf.Broker.Overflow,
+		SpillDir:            conf.Broker.SpillDir,
+		SpillMaxSize:        conf.Broker.SpillMaxSize,
 	})
 
+	serveHTTP(conf, manager)
+
 	evts := make(map[string]struct{})
 	for _, e := range conf.Events {
 		evts[e] = struct{}{}
@@ -156,4 +188,11 @@ func Run() {
 	if err := manager.Start(ctx); err != nil {
 		logger.Fatalf("failed to connect to discord: %v", err)
 	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout.Duration)
+	defer cancel()
+
+	if err := manager.Drain(drainCtx); err != nil {
+		logger.Printf("unable to publish all packets before exiting: %v", err)
+	}
 }
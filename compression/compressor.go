@@ -1,7 +1,69 @@
 package compression
 
-// Compressor is something that can de/compress data
+import "errors"
+
+// Decompressor decompresses a transport-compressed stream one message at a time
+type Decompressor interface {
+	Decompress([]byte) ([]byte, error)
+}
+
+// Compressor compresses messages into a stream that a Decompressor of the same type can read.
+// Discord doesn't accept compressed payloads, so this is only useful for producing test data and
+// for connecting to proxies that serve the gateway protocol themselves.
 type Compressor interface {
 	Compress([]byte) []byte
-	Decompress([]byte) ([]byte, error)
+}
+
+// Transport compression types supported by the Discord gateway
+const (
+	TypeNone       = "none"
+	TypeZlibStream = "zlib-stream"
+	TypeZstdStream = "zstd-stream"
+)
+
+// ErrUnsupported occurs when a compression type is unknown or unavailable in this build
+var ErrUnsupported = errors.New("unsupported compression type")
+
+// constructors contains the compression types available in this build
+var constructors = map[string]func() Decompressor{
+	TypeNone:       func() Decompressor { return None{} },
+	TypeZlibStream: func() Decompressor { return NewZlib() },
+}
+
+// New creates a decompressor of the given type
+func New(t string) (Decompressor, error) {
+	newDecompressor, ok := constructors[t]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	return newDecompressor(), nil
+}
+
+// NewCompressor creates a compressor of the given type
+func NewCompressor(t string) (Compressor, error) {
+	d, err := New(t)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := d.(Compressor)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return c, nil
+}
+
+// Supported returns whether the given compression type is available in this build
+func Supported(t string) bool {
+	_, ok := constructors[t]
+	return ok
+}
+
+// Default returns the preferred compression type available in this build
+func Default() string {
+	if Supported(TypeZstdStream) {
+		return TypeZstdStream
+	}
+	return TypeZlibStream
 }
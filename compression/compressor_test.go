@@ -0,0 +1,262 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// benchmarkDecompress measures decompressing a stream of gateway frames compressed by c
+func benchmarkDecompress(b *testing.B, c Compressor, d Decompressor) {
+	frames := gatewayFrames()
+	compressed := make([][]byte, b.N)
+
+	var size int
+	for i := range compressed {
+		frame := frames[i%len(frames)]
+		compressed[i] = c.Compress(frame)
+		size += len(frame)
+	}
+
+	b.SetBytes(int64(size / b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for _, frame := range compressed {
+		if _, err := d.Decompress(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// compressAll compresses each message in turn with c
+func compressAll(c Compressor, messages [][]byte) [][]byte {
+	compressed := make([][]byte, len(messages))
+	for i, m := range messages {
+		compressed[i] = c.Compress(m)
+	}
+	return compressed
+}
+
+// largePayload returns a payload of about n bytes made of gateway frames, with some incompressible
+// data mixed in
+func largePayload(n int) []byte {
+	r := rand.New(rand.NewPCG(3, 4))
+	frames := gatewayFrames()
+
+	b := make([]byte, 0, n+len(frames[0]))
+	for i := 0; len(b) < n; i++ {
+		b = append(b, frames[i%len(frames)]...)
+		if i%10 == 0 {
+			for j := 0; j < 1<<14; j++ {
+				b = append(b, byte(r.Uint32()))
+			}
+		}
+	}
+	return b
+}
+
+// checkStream decompresses each compressed message, fed in pieces of at most split bytes unless
+// split is 0, and checks that the pieces decompress into the original message
+func checkStream(t *testing.T, d Decompressor, messages, compressed [][]byte, split int) {
+	t.Helper()
+
+	var out []byte
+	for i, c := range compressed {
+		out = out[:0]
+		for len(c) > 0 {
+			n := len(c)
+			if split > 0 {
+				n = min(n, split)
+			}
+
+			b, err := d.Decompress(c[:n])
+			if err != nil {
+				t.Fatalf("message %d: %s", i, err)
+			}
+
+			out = append(out, b...)
+			c = c[n:]
+		}
+
+		if !bytes.Equal(out, messages[i]) {
+			t.Fatalf("message %d: got %d bytes, want %d", i, len(out), len(messages[i]))
+		}
+	}
+}
+
+// checkAllocs checks that decompressing a stream doesn't allocate once its buffers have grown
+func checkAllocs(t *testing.T, c Compressor, d Decompressor) {
+	t.Helper()
+
+	frames := gatewayFrames()
+	compressed := compressAll(c, append(frames, frames...))
+	checkStream(t, d, frames, compressed[:len(frames)], 0)
+
+	i := len(frames)
+	allocs := testing.AllocsPerRun(len(frames)-1, func() {
+		if _, err := d.Decompress(compressed[i]); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	})
+
+	if allocs != 0 {
+		t.Errorf("got %f allocations per message, want 0", allocs)
+	}
+}
+
+// codecs returns a compressor and a decompressor of each type available in this build, and of the
+// pure Go zstd implementation
+func codecs(t *testing.T) map[string]func() (Compressor, Decompressor) {
+	codecs := map[string]func() (Compressor, Decompressor){
+		"zstd-stream (pure)": func() (Compressor, Decompressor) { return NewPureZstd(), NewPureZstd() },
+	}
+
+	for typ := range constructors {
+		codecs[typ] = func() (Compressor, Decompressor) {
+			c, err := NewCompressor(typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := New(typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c, d
+		}
+	}
+	return codecs
+}
+
+func TestRoundTrip(t *testing.T) {
+	frames := gatewayFrames()
+	tests := []struct {
+		name     string
+		messages [][]byte
+		split    int
+	}{
+		{"whole", frames, 0},
+		{"split bytes", frames[1:50], 1},
+		{"split", frames, 3},
+		{"split large", frames, 4096},
+		{"empty", [][]byte{[]byte("{}"), {}, []byte("{}")}, 0},
+		{"large", [][]byte{frames[1], largePayload(4 << 20), frames[2]}, 0},
+	}
+
+	for name, newCodec := range codecs(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					messages := tt.messages
+					if name == TypeNone {
+						// without compression, empty messages can't be told apart from split ones
+						messages = slices.DeleteFunc(slices.Clone(messages), func(m []byte) bool { return len(m) == 0 })
+					}
+
+					c, d := newCodec()
+					checkStream(t, d, messages, compressAll(c, messages), tt.split)
+				})
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := New("lz4"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("New: got error %v, want %v", err, ErrUnsupported)
+	}
+
+	if _, err := NewCompressor("lz4"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("NewCompressor: got error %v, want %v", err, ErrUnsupported)
+	}
+
+	if Supported("lz4") {
+		t.Error("lz4 is supported")
+	}
+
+	if !Supported(Default()) {
+		t.Errorf("default %s is not supported", Default())
+	}
+}
+
+func TestZlibSuffix(t *testing.T) {
+	frames := gatewayFrames()
+	c := NewZlib()
+	compressed := compressAll(c, frames[:20])
+
+	tests := []struct {
+		name string
+		// cut returns where a message is split, given its length
+		cut func(n int) []int
+	}{
+		{"before suffix", func(n int) []int { return []int{n - 4} }},
+		{"inside suffix", func(n int) []int { return []int{n - 3, n - 1} }},
+		{"every suffix byte", func(n int) []int { return []int{n - 4, n - 3, n - 2, n - 1} }},
+		{"header", func(n int) []int { return []int{1, n - 2} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewZlib()
+			for i, m := range compressed {
+				cuts := tt.cut(len(m))
+				if i > 0 && cuts[0] == 1 {
+					cuts = cuts[1:]
+				}
+
+				start := 0
+				for _, end := range cuts {
+					// nothing is returned until the sync flush suffix is received
+					out, err := d.Decompress(m[start:end])
+					if err != nil {
+						t.Fatalf("message %d: %s", i, err)
+					}
+					if len(out) != 0 {
+						t.Fatalf("message %d: got %d bytes before the suffix", i, len(out))
+					}
+					start = end
+				}
+
+				out, err := d.Decompress(m[start:])
+				if err != nil {
+					t.Fatalf("message %d: %s", i, err)
+				}
+
+				if !bytes.Equal(out, frames[i]) {
+					t.Fatalf("message %d: got %d bytes, want %d", i, len(out), len(frames[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestZlibSuffixInMessage(t *testing.T) {
+	// a message flushed twice contains the suffix in the middle, so it's returned in two parts
+	c := NewZlib()
+	first, second := c.Compress([]byte(`{"op":0,`)), c.Compress([]byte(`"d":null}`))
+	message := append(bytes.Clone(first), second...)
+
+	d := NewZlib()
+	var out []byte
+	for _, part := range [][]byte{message[:len(first)], message[len(first):]} {
+		b, err := d.Decompress(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, b...)
+	}
+
+	if string(out) != `{"op":0,"d":null}` {
+		t.Errorf("got %s", out)
+	}
+}
+
+func TestZlibInvalidHeader(t *testing.T) {
+	if _, err := NewZlib().Decompress([]byte{0x00, 0x01, 0x00, 0x00, 0xff, 0xff}); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidHeader)
+	}
+}
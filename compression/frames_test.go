@@ -0,0 +1,106 @@
+package compression
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"strconv"
+)
+
+// gatewayFrames returns dispatch payloads resembling what a shard receives: a large
+// GUILD_CREATE followed by a mix of the smaller events that make up most traffic
+func gatewayFrames() [][]byte {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	snowflake := func() string {
+		return strconv.FormatUint(r.Uint64N(1<<62)+175928847299117063, 10)
+	}
+
+	user := func() map[string]any {
+		return map[string]any{
+			"id":            snowflake(),
+			"username":      "user" + strconv.Itoa(r.IntN(100000)),
+			"discriminator": "0",
+			"global_name":   nil,
+			"avatar":        strconv.FormatUint(r.Uint64(), 16) + strconv.FormatUint(r.Uint64(), 16),
+			"bot":           r.IntN(20) == 0,
+		}
+	}
+
+	dispatch := func(seq int, event string, d any) []byte {
+		b, err := json.Marshal(map[string]any{"op": 0, "s": seq, "t": event, "d": d})
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}
+
+	guildID := snowflake()
+	members := make([]any, 1000)
+	for i := range members {
+		members[i] = map[string]any{
+			"user":      user(),
+			"roles":     []string{snowflake(), snowflake()},
+			"joined_at": "2021-06-01T12:00:00.000000+00:00",
+			"deaf":      false,
+			"mute":      false,
+			"flags":     0,
+		}
+	}
+
+	channels := make([]any, 100)
+	for i := range channels {
+		channels[i] = map[string]any{
+			"id":       snowflake(),
+			"type":     0,
+			"name":     "channel-" + strconv.Itoa(i),
+			"position": i,
+			"topic":    "Talk about anything related to channel " + strconv.Itoa(i),
+		}
+	}
+
+	frames := [][]byte{dispatch(1, "GUILD_CREATE", map[string]any{
+		"id":           guildID,
+		"name":         "Spectacles",
+		"member_count": len(members),
+		"members":      members,
+		"channels":     channels,
+	})}
+
+	for seq := 2; len(frames) < 500; seq++ {
+		var frame []byte
+		switch r.IntN(4) {
+		case 0, 1:
+			frame = dispatch(seq, "MESSAGE_CREATE", map[string]any{
+				"id":         snowflake(),
+				"guild_id":   guildID,
+				"channel_id": snowflake(),
+				"author":     user(),
+				"content":    "message number " + strconv.Itoa(seq) + " with some text in it",
+				"timestamp":  "2024-05-19T05:22:38.000000+00:00",
+				"tts":        false,
+				"mentions":   []any{},
+				"embeds":     []any{},
+			})
+		case 2:
+			frame = dispatch(seq, "PRESENCE_UPDATE", map[string]any{
+				"guild_id": guildID,
+				"user":     map[string]any{"id": snowflake()},
+				"status":   "online",
+				"activities": []any{map[string]any{
+					"name": "Spectacles",
+					"type": 0,
+				}},
+				"client_status": map[string]any{"desktop": "online"},
+			})
+		default:
+			frame = dispatch(seq, "TYPING_START", map[string]any{
+				"guild_id":   guildID,
+				"channel_id": snowflake(),
+				"user_id":    snowflake(),
+				"timestamp":  1716096158,
+			})
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
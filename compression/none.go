@@ -0,0 +1,14 @@
+package compression
+
+// None passes data through without compression
+type None struct{}
+
+// Compress returns the given bytes
+func (None) Compress(d []byte) []byte {
+	return d
+}
+
+// Decompress returns the given bytes
+func (None) Decompress(d []byte) ([]byte, error) {
+	return d, nil
+}
@@ -0,0 +1,96 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// zlibSuffix terminates every message in a zlib stream (Z_SYNC_FLUSH)
+var zlibSuffix = []byte{0x00, 0x00, 0xff, 0xff}
+
+// zlibWindow is the maximum distance a zlib stream can refer back to
+const zlibWindow = 32 << 10
+
+// ErrInvalidHeader occurs when a zlib stream does not begin with a valid header
+var ErrInvalidHeader = errors.New("invalid zlib header")
+
+// Zlib represents a zlib-stream de/compression context. Zero value is not valid.
+//
+// Each message in the stream ends with a sync flush, so decompression resumes at a block boundary
+// with the previous output as its dictionary, rather than keeping a reader blocked between
+// messages.
+type Zlib struct {
+	cw  *zlib.Writer
+	cwb bytes.Buffer
+
+	header bool
+	in     []byte
+	dr     io.ReadCloser
+	out    bytes.Buffer
+	window []byte
+}
+
+// NewZlib creates a valid zlib context
+func NewZlib() *Zlib {
+	z := &Zlib{}
+	z.cw = zlib.NewWriter(&z.cwb)
+	return z
+}
+
+// Compress compresses the given bytes and returns the compressed form, ending in a sync flush
+func (z *Zlib) Compress(d []byte) []byte {
+	z.cwb.Reset()
+	z.cw.Write(d)
+	z.cw.Flush()
+	return bytes.Clone(z.cwb.Bytes())
+}
+
+// Decompress decompresses the given bytes and returns the decompressed form. Input is buffered
+// until the sync flush suffix is received, returning no data in the meantime. The returned slice
+// is only valid until the next call.
+func (z *Zlib) Decompress(d []byte) ([]byte, error) {
+	z.in = append(z.in, d...)
+	if !bytes.HasSuffix(z.in, zlibSuffix) {
+		return nil, nil
+	}
+
+	in := z.in
+	z.in = z.in[:0]
+
+	if !z.header {
+		if len(in) < 2 || in[0]&0x0f != 8 || (uint16(in[0])<<8|uint16(in[1]))%31 != 0 {
+			return nil, ErrInvalidHeader
+		}
+
+		in = in[2:]
+		z.header = true
+	}
+
+	src := bytes.NewReader(in)
+	if z.dr == nil {
+		z.dr = flate.NewReaderDict(src, z.window)
+	} else if err := z.dr.(flate.Resetter).Reset(src, z.window); err != nil {
+		return nil, err
+	}
+
+	// without a final block, the reader runs out of input once the message is complete
+	z.out.Reset()
+	if _, err := z.out.ReadFrom(z.dr); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	out := z.out.Bytes()
+	if len(out) >= zlibWindow {
+		z.window = append(z.window[:0], out[len(out)-zlibWindow:]...)
+	} else {
+		z.window = append(z.window, out...)
+		if len(z.window) > zlibWindow {
+			z.window = append(z.window[:0], z.window[len(z.window)-zlibWindow:]...)
+		}
+	}
+
+	return out, nil
+}
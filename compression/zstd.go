@@ -1,44 +1,90 @@
+//go:build cgo && !purezstd
+
 package compression
 
 import (
+	"bytes"
 	"io"
+	"slices"
 
 	"github.com/valyala/gozstd"
 )
 
+func init() {
+	constructors[TypeZstdStream] = func() Decompressor { return NewZstd() }
+}
+
 // Zstd represents a de/compression context. Zero value is not valid.
+//
+// Each message is decompressed as soon as it's received: the reader is given the message and
+// reports the end of input once it has consumed all of it, after which it continues with the next
+// message.
 type Zstd struct {
-	cw *gozstd.Writer
-	cr *ChanWriter
-	dw io.Writer
-	dr *ChanWriter
+	cw  *gozstd.Writer
+	cwb bytes.Buffer
+
+	zr  *gozstd.Reader
+	in  messageReader
+	out []byte
 }
 
 // NewZstd creates a valid zstd context
 func NewZstd() *Zstd {
-	cr := &ChanWriter{make(chan []byte)}
-	zw := gozstd.NewWriter(cr)
-
-	dr, dw := io.Pipe()
-	zr := gozstd.NewReader(dr)
-	dChanWriter := &ChanWriter{make(chan []byte)}
-	go zr.WriteTo(dChanWriter)
-	return &Zstd{zw, cr, dw, dChanWriter}
+	z := &Zstd{}
+	z.cw = gozstd.NewWriter(&z.cwb)
+	z.zr = gozstd.NewReader(&z.in)
+	return z
 }
 
 // Compress compresses the given bytes and returns the compressed form
 func (z *Zstd) Compress(d []byte) []byte {
+	z.cwb.Reset()
 	z.cw.Write(d)
-	go z.cw.Flush()
-	return <-z.cr.C
+	z.cw.Flush()
+	return bytes.Clone(z.cwb.Bytes())
 }
 
-// Decompress decompresses the given bytes and returns the decompressed form
+// Decompress decompresses the given bytes and returns the decompressed form. The returned slice
+// is only valid until the next call.
 func (z *Zstd) Decompress(d []byte) ([]byte, error) {
-	_, err := z.dw.Write(d)
-	if err != nil {
-		return []byte{}, err
+	z.in.b = d
+	z.out = z.out[:0]
+
+	for {
+		if len(z.out) == cap(z.out) {
+			z.out = slices.Grow(z.out, max(cap(z.out), zstdChunkSize))
+		}
+
+		n, err := z.zr.Read(z.out[len(z.out):cap(z.out)])
+		z.out = z.out[:len(z.out)+n]
+
+		switch {
+		case err == io.EOF:
+			return z.out, nil
+		case err != nil:
+			return nil, err
+		}
+	}
+}
+
+// Close releases the zstd contexts
+func (z *Zstd) Close() error {
+	z.zr.Release()
+	z.cw.Release()
+	return nil
+}
+
+// messageReader reads the current message, reporting the end of input once it has been read
+type messageReader struct {
+	b []byte
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
 	}
 
-	return <-z.dr.C, nil
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
 }
@@ -0,0 +1,261 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdChunkSize is the size decompressed messages are initially buffered in
+const zstdChunkSize = 32 << 10
+
+// ErrInvalidZstd occurs when a zstd stream contains an invalid frame or block header
+var ErrInvalidZstd = errors.New("invalid zstd stream")
+
+// PureZstd represents a zstd de/compression context implemented in pure Go. Zero value is not
+// valid.
+//
+// The decoder keeps returning the first error it reads, so it can't be told that a message has
+// ended. Instead, it runs in a goroutine of its own and is only given complete blocks: once it has
+// decoded all of them and asks for more, it blocks until the next message is received, and
+// Decompress returns what it has decoded so far. The goroutine is started by the first message
+// and stopped by Close.
+type PureZstd struct {
+	cw  *zstd.Encoder
+	cwb bytes.Buffer
+
+	zr   *zstd.Decoder
+	in   zstdBlocks
+	out  bytes.Buffer
+	errs chan error
+	err  error
+}
+
+// NewPureZstd creates a valid pure Go zstd context
+func NewPureZstd() *PureZstd {
+	return &PureZstd{}
+}
+
+// Compress compresses the given bytes and returns the compressed form
+func (z *PureZstd) Compress(d []byte) []byte {
+	if z.cw == nil {
+		z.cw, _ = zstd.NewWriter(&z.cwb)
+	}
+
+	z.cwb.Reset()
+	z.cw.Write(d)
+	z.cw.Flush()
+	return bytes.Clone(z.cwb.Bytes())
+}
+
+// Decompress decompresses the given bytes and returns the decompressed form. Incomplete blocks
+// are buffered until the rest of them is received. The returned slice is only valid until the
+// next call.
+func (z *PureZstd) Decompress(d []byte) ([]byte, error) {
+	if z.err != nil {
+		return nil, z.err
+	}
+
+	if z.zr == nil {
+		if err := z.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := z.in.push(d); err != nil {
+		return nil, err
+	}
+
+	z.out.Reset()
+	if z.in.pos == z.in.complete {
+		return z.out.Bytes(), nil
+	}
+
+	// hand the new blocks to the decoder and wait for it to decode all of them
+	z.in.input <- struct{}{}
+	if err := z.wait(); err != nil {
+		return nil, err
+	}
+	return z.out.Bytes(), nil
+}
+
+// start starts decoding in the background, returning once the decoder waits for input
+func (z *PureZstd) start() (err error) {
+	z.zr, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return
+	}
+
+	z.in.input = make(chan struct{})
+	z.in.drained = make(chan struct{})
+	z.errs = make(chan error, 1)
+	z.out.Grow(zstdChunkSize)
+
+	go func() {
+		if err := z.zr.Reset(&z.in); err != nil {
+			z.errs <- err
+			return
+		}
+
+		_, err := z.zr.WriteTo(&z.out)
+		z.errs <- err
+	}()
+	return z.wait()
+}
+
+// wait waits until the decoder has read every complete block, returning the error it stopped
+// with if it stops instead
+func (z *PureZstd) wait() error {
+	select {
+	case <-z.in.drained:
+		return nil
+	case z.err = <-z.errs:
+		if z.err == nil {
+			z.err = io.ErrUnexpectedEOF
+		}
+		return z.err
+	}
+}
+
+// Close stops the decoder and releases the encoder
+func (z *PureZstd) Close() error {
+	if z.zr != nil {
+		if z.err == nil {
+			close(z.in.input)
+			<-z.errs
+			z.err = io.ErrClosedPipe
+		}
+		z.zr.Close()
+	}
+
+	if z.cw != nil {
+		return z.cw.Close()
+	}
+	return nil
+}
+
+// zstd frame and block headers
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+	zstdBlockRLE       = 1
+	zstdBlockReserved  = 3
+)
+
+// zstdBlocks buffers a zstd stream, only letting it be read up to the end of the last complete
+// frame header or block
+type zstdBlocks struct {
+	buf      []byte
+	pos      int
+	complete int
+
+	inFrame  bool
+	checksum bool
+
+	// input is sent to once more blocks are complete, and closed once there won't be any more;
+	// drained is sent to once every complete block has been read
+	input   chan struct{}
+	drained chan struct{}
+}
+
+// push appends data to the stream
+func (b *zstdBlocks) push(d []byte) error {
+	if b.pos > 0 {
+		n := copy(b.buf, b.buf[b.pos:])
+		b.buf = b.buf[:n]
+		b.complete -= b.pos
+		b.pos = 0
+	}
+
+	b.buf = append(b.buf, d...)
+	return b.scan()
+}
+
+// scan advances complete past every complete frame header and block
+func (b *zstdBlocks) scan() error {
+	for {
+		rest := b.buf[b.complete:]
+		inFrame, checksum := b.inFrame, b.checksum
+		n := 0
+
+		if !inFrame {
+			if len(rest) < 4 {
+				return nil
+			}
+
+			magic := binary.LittleEndian.Uint32(rest)
+			switch {
+			case magic&^0xf == zstdSkippableMagic:
+				if len(rest) < 8 {
+					return nil
+				}
+				n = 8 + int(binary.LittleEndian.Uint32(rest[4:]))
+
+			case magic == zstdMagic:
+				if len(rest) < 5 {
+					return nil
+				}
+
+				// dictionary ID and content size, followed by a window descriptor unless the
+				// frame is a single segment, whose content size is always present
+				fhd := rest[4]
+				n = 5 + [4]int{0, 1, 2, 4}[fhd&3] + [4]int{0, 2, 4, 8}[fhd>>6]
+				if fhd&(1<<5) == 0 || fhd>>6 == 0 {
+					n++
+				}
+
+				inFrame, checksum = true, fhd&(1<<2) != 0
+
+			default:
+				return ErrInvalidZstd
+			}
+		} else {
+			if len(rest) < 3 {
+				return nil
+			}
+
+			header := int(rest[0]) | int(rest[1])<<8 | int(rest[2])<<16
+			switch header >> 1 & 3 {
+			case zstdBlockRLE:
+				n = 4
+			case zstdBlockReserved:
+				return ErrInvalidZstd
+			default:
+				n = 3 + header>>3
+			}
+
+			// the checksum is read along with the last block
+			if header&1 != 0 {
+				if checksum {
+					n += 4
+				}
+				inFrame = false
+			}
+		}
+
+		if len(rest) < n {
+			return nil
+		}
+
+		b.complete += n
+		b.inFrame, b.checksum = inFrame, checksum
+	}
+}
+
+// Read reads the stream up to the end of the last complete frame header or block, blocking once
+// it has read all of it until more blocks are complete
+func (b *zstdBlocks) Read(p []byte) (int, error) {
+	for b.pos == b.complete {
+		b.drained <- struct{}{}
+		if _, ok := <-b.input; !ok {
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n := copy(p, b.buf[b.pos:b.complete])
+	b.pos += n
+	return n, nil
+}
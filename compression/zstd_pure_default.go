@@ -0,0 +1,7 @@
+//go:build !cgo || purezstd
+
+package compression
+
+func init() {
+	constructors[TypeZstdStream] = func() Decompressor { return NewPureZstd() }
+}
@@ -0,0 +1,85 @@
+package compression
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testZstd checks that messages compressed by newCompressor are decompressed by newDecompressor,
+// whole and split between calls, including payloads of several megabytes
+func testZstd(t *testing.T, newCompressor func() Compressor, newDecompressor func() Decompressor) {
+	frames := gatewayFrames()
+
+	t.Run("messages", func(t *testing.T) {
+		checkStream(t, newDecompressor(), frames, compressAll(newCompressor(), frames), 0)
+	})
+
+	t.Run("split", func(t *testing.T) {
+		for _, split := range []int{1, 7, 1000, 100000} {
+			messages := frames
+			if split == 1 {
+				// skip the GUILD_CREATE, which takes long to feed byte by byte
+				messages = frames[1:100]
+			}
+			checkStream(t, newDecompressor(), messages, compressAll(newCompressor(), messages), split)
+		}
+	})
+
+	t.Run("large", func(t *testing.T) {
+		messages := [][]byte{frames[2], largePayload(8 << 20), frames[3], largePayload(3 << 20), frames[4]}
+		compressed := compressAll(newCompressor(), messages)
+		checkStream(t, newDecompressor(), messages, compressed, 0)
+		checkStream(t, newDecompressor(), messages, compressed, 64<<10)
+	})
+
+	t.Run("allocations", func(t *testing.T) {
+		checkAllocs(t, newCompressor(), newDecompressor())
+	})
+}
+
+func TestPureZstd(t *testing.T) {
+	testZstd(t,
+		func() Compressor { return NewPureZstd() },
+		func() Decompressor { return NewPureZstd() },
+	)
+}
+
+func TestPureZstdFrames(t *testing.T) {
+	// every message in a frame of its own, with a content size and checksum
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := gatewayFrames()[:50]
+	messages = append(messages, largePayload(2<<20))
+
+	compressed := make([][]byte, len(messages))
+	for i, m := range messages {
+		compressed[i] = enc.EncodeAll(m, nil)
+	}
+
+	// a skippable frame before the first message
+	compressed[0] = append([]byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}, compressed[0]...)
+
+	for _, split := range []int{0, 1, 5} {
+		checkStream(t, NewPureZstd(), messages, compressed, split)
+	}
+}
+
+func TestPureZstdInvalid(t *testing.T) {
+	z := NewPureZstd()
+	if _, err := z.Decompress([]byte("not zstd")); !errors.Is(err, ErrInvalidZstd) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidZstd)
+	}
+}
+
+func BenchmarkPureZstd(b *testing.B) {
+	c, d := NewPureZstd(), NewPureZstd()
+	defer c.Close()
+	defer d.Close()
+
+	benchmarkDecompress(b, c, d)
+}
@@ -0,0 +1,35 @@
+//go:build cgo && !purezstd
+
+package compression
+
+import "testing"
+
+func TestZstd(t *testing.T) {
+	testZstd(t,
+		func() Compressor { return NewZstd() },
+		func() Decompressor { return NewZstd() },
+	)
+}
+
+// Discord compresses with the reference implementation, so the pure Go decoder must read its
+// streams
+func TestPureZstdReference(t *testing.T) {
+	testZstd(t,
+		func() Compressor { return NewZstd() },
+		func() Decompressor { return NewPureZstd() },
+	)
+}
+
+func TestZstdInvalid(t *testing.T) {
+	if _, err := NewZstd().Decompress([]byte("not a zstd stream")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func BenchmarkZstd(b *testing.B) {
+	c, d := NewZstd(), NewZstd()
+	defer c.Close()
+	defer d.Close()
+
+	benchmarkDecompress(b, c, d)
+}
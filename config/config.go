@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/spec-tacles/gateway/compression"
+	"github.com/spec-tacles/gateway/gateway"
 	"github.com/spec-tacles/go/types"
 )
 
@@ -22,30 +25,74 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 	return
 }
 
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// redacted replaces secrets in config dumps
+const redacted = "[redacted]"
+
 // Config represents configuration structure for the gateway
 type Config struct {
 	Token          string
 	Events         []string
 	Intents        []string
 	RawIntents     uint
-	GatewayVersion uint `toml:"gateway_version"`
-	Shards         struct {
-		Count int
-		IDs   []int
+	GatewayVersion uint   `toml:"gateway_version"`
+	Compression    string // transport compression: "zstd-stream", "zlib-stream" or "none"
+	Encoding       string // payload encoding: "json" or "etf"
+	RawETF         bool   `toml:"raw_etf"` // publish ETF event data without converting it to JSON
+
+	// ShutdownTimeout is the time allowed for closing shards and draining the broker on exit
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+
+	Shards struct {
+		Count               int
+		IDs                 []int
+		ServerIndex         int  `toml:"server_index"`
+		ServerCount         int  `toml:"server_count"`
+		SessionStartReserve int  `toml:"session_start_reserve"`
+		SuppressDuplicates  bool `toml:"suppress_duplicates"`
+
+		// ReshardInterval is how often Discord's recommended shard count is checked; 0 disables it
+		ReshardInterval duration `toml:"reshard_interval"`
 	}
 	Broker struct {
 		Type           string
 		Group          string
 		MessageTimeout duration `toml:"message_timeout"`
+		Envelope       string   // published event format: "none", "json" or "binary"
+		InstanceID     string   `toml:"instance_id"`
+		PartitionKey   string   `toml:"partition_key"` // "guild_id" or "channel_id"
+		Partitions     int
+		PublishWorkers int    `toml:"publish_workers"`
+		QueueSize      int    `toml:"queue_size"`
+		Overflow       string // full publish queue policy: "block", "drop_oldest" or "spill"
+		SpillDir       string `toml:"spill_dir"`
+		SpillMaxSize   int64  `toml:"spill_max_size"`
 	}
 	Prometheus struct {
 		Address  string
 		Endpoint string
 	}
+	Admin struct {
+		Address string
+		Token   string
+	}
+	Health struct {
+		Address  string
+		MinReady *float64 `toml:"min_ready"` // defaults to 1 if unset, so that 0 can be configured
+	}
 	ShardStore struct {
-		Type   string
-		Prefix string
+		Type       string
+		Prefix     string
+		SessionTTL duration `toml:"session_ttl"` // how long sessions are resumed after they were stored
 	} `toml:"shard_store"`
+	ShardCoordinator struct {
+		Type     string
+		Prefix   string
+		LeaseTTL duration `toml:"lease_ttl"`
+	} `toml:"shard_coordinator"`
 	Presence types.StatusUpdate
 
 	API struct {
@@ -131,6 +178,97 @@ func (c *Config) Init() error {
 		}
 	}
 
+	if c.Compression == "" {
+		c.Compression = compression.Default()
+	}
+
+	if !compression.Supported(c.Compression) {
+		return fmt.Errorf("unsupported compression %q", c.Compression)
+	}
+
+	switch c.Encoding {
+	case "":
+		c.Encoding = gateway.EncodingJSON
+	case gateway.EncodingJSON, gateway.EncodingETF:
+	default:
+		return fmt.Errorf("unsupported encoding %q", c.Encoding)
+	}
+
+	if c.RawETF && c.Encoding != gateway.EncodingETF {
+		return fmt.Errorf("raw_etf requires the %q encoding", gateway.EncodingETF)
+	}
+
+	switch c.Broker.Envelope {
+	case "":
+		c.Broker.Envelope = gateway.EnvelopeNone
+	case gateway.EnvelopeNone, gateway.EnvelopeJSON, gateway.EnvelopeBinary:
+	default:
+		return fmt.Errorf("unsupported envelope %q", c.Broker.Envelope)
+	}
+
+	switch c.Broker.PartitionKey {
+	case "", gateway.PartitionKeyGuild, gateway.PartitionKeyChannel:
+	default:
+		return fmt.Errorf("unsupported partition key %q", c.Broker.PartitionKey)
+	}
+
+	if c.Broker.Partitions < 0 {
+		return errors.New("broker partitions must not be negative")
+	}
+
+	// none of the supported brokers can publish events by key, so they must be split between topics
+	if c.Broker.PartitionKey != "" && c.Broker.Partitions <= 1 {
+		return errors.New("partition_key requires more than one broker partition")
+	}
+
+	if c.Shards.ReshardInterval.Duration < 0 {
+		return errors.New("reshard interval must not be negative")
+	}
+
+	if c.ShardStore.SessionTTL.Duration < 0 {
+		return errors.New("session TTL must not be negative")
+	}
+
+	switch c.ShardCoordinator.Type {
+	case "", "redis":
+	default:
+		return fmt.Errorf("unsupported shard coordinator %q", c.ShardCoordinator.Type)
+	}
+
+	// shards taken over from other processes must resume from the sessions they stored
+	if c.ShardCoordinator.Type != "" && c.ShardStore.Type != "redis" {
+		return errors.New("a shard coordinator requires a redis shard store shared by every process")
+	}
+
+	if c.ShardCoordinator.LeaseTTL.Duration < 0 {
+		return errors.New("shard lease TTL must not be negative")
+	}
+
+	switch c.Broker.Overflow {
+	case "":
+		c.Broker.Overflow = gateway.OverflowBlock
+	case gateway.OverflowBlock, gateway.OverflowDropOldest:
+	case gateway.OverflowSpill:
+		if c.Broker.SpillDir == "" {
+			return errors.New("the spill overflow policy requires a spill directory")
+		}
+	default:
+		return fmt.Errorf("unsupported overflow policy %q", c.Broker.Overflow)
+	}
+
+	if c.Broker.PublishWorkers < 0 || c.Broker.QueueSize < 0 || c.Broker.SpillMaxSize < 0 {
+		return errors.New("broker publish workers, queue size and spill size must not be negative")
+	}
+
+	if c.ShutdownTimeout.Duration == time.Duration(0) {
+		c.ShutdownTimeout = duration{10 * time.Second}
+	}
+
+	if c.Health.MinReady == nil {
+		minReady := 1.0
+		c.Health.MinReady = &minReady
+	}
+
 	if c.Redis.PoolSize == 0 {
 		c.Redis.PoolSize = 5
 	}
@@ -197,6 +335,32 @@ func (c *Config) LoadEnv() {
 		}
 	}
 
+	v = os.Getenv("DISCORD_COMPRESSION")
+	if v != "" {
+		c.Compression = v
+	}
+
+	v = os.Getenv("DISCORD_ENCODING")
+	if v != "" {
+		c.Encoding = v
+	}
+
+	v = os.Getenv("DISCORD_RAW_ETF")
+	if v != "" {
+		raw, err := strconv.ParseBool(v)
+		if err == nil {
+			c.RawETF = raw
+		}
+	}
+
+	v = os.Getenv("SHUTDOWN_TIMEOUT")
+	if v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err == nil {
+			c.ShutdownTimeout = duration{timeout}
+		}
+	}
+
 	v = os.Getenv("DISCORD_SHARD_COUNT")
 	if v != "" {
 		i, err := strconv.ParseUint(v, 10, 32)
@@ -208,15 +372,55 @@ func (c *Config) LoadEnv() {
 	v = os.Getenv("DISCORD_SHARD_IDS")
 	if v != "" {
 		ids := strings.Split(v, ",")
-		c.Shards.IDs = make([]int, len(ids))
-		for i, id := range ids {
-			convID, err := strconv.Atoi(id)
+		c.Shards.IDs = make([]int, 0, len(ids))
+		for _, id := range ids {
+			convID, err := strconv.Atoi(strings.TrimSpace(id))
 			if err == nil {
-				c.Shards.IDs[i] = convID
+				c.Shards.IDs = append(c.Shards.IDs, convID)
 			}
 		}
 	}
 
+	v = os.Getenv("DISCORD_SHARD_SERVER_INDEX")
+	if v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil {
+			c.Shards.ServerIndex = i
+		}
+	}
+
+	v = os.Getenv("DISCORD_SHARD_SERVER_COUNT")
+	if v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil {
+			c.Shards.ServerCount = i
+		}
+	}
+
+	v = os.Getenv("DISCORD_SESSION_START_RESERVE")
+	if v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil {
+			c.Shards.SessionStartReserve = i
+		}
+	}
+
+	v = os.Getenv("DISCORD_SUPPRESS_DUPLICATES")
+	if v != "" {
+		suppress, err := strconv.ParseBool(v)
+		if err == nil {
+			c.Shards.SuppressDuplicates = suppress
+		}
+	}
+
+	v = os.Getenv("DISCORD_RESHARD_INTERVAL")
+	if v != "" {
+		interval, err := time.ParseDuration(v)
+		if err == nil {
+			c.Shards.ReshardInterval = duration{interval}
+		}
+	}
+
 	v = os.Getenv("DISCORD_PRESENCE")
 	if v != "" {
 		var presence types.StatusUpdate
@@ -262,6 +466,63 @@ func (c *Config) LoadEnv() {
 		}
 	}
 
+	v = os.Getenv("BROKER_ENVELOPE")
+	if v != "" {
+		c.Broker.Envelope = v
+	}
+
+	v = os.Getenv("BROKER_INSTANCE_ID")
+	if v != "" {
+		c.Broker.InstanceID = v
+	}
+
+	v = os.Getenv("BROKER_PARTITION_KEY")
+	if v != "" {
+		c.Broker.PartitionKey = v
+	}
+
+	v = os.Getenv("BROKER_PARTITIONS")
+	if v != "" {
+		partitions, err := strconv.Atoi(v)
+		if err == nil {
+			c.Broker.Partitions = partitions
+		}
+	}
+
+	v = os.Getenv("BROKER_PUBLISH_WORKERS")
+	if v != "" {
+		workers, err := strconv.Atoi(v)
+		if err == nil {
+			c.Broker.PublishWorkers = workers
+		}
+	}
+
+	v = os.Getenv("BROKER_QUEUE_SIZE")
+	if v != "" {
+		size, err := strconv.Atoi(v)
+		if err == nil {
+			c.Broker.QueueSize = size
+		}
+	}
+
+	v = os.Getenv("BROKER_OVERFLOW")
+	if v != "" {
+		c.Broker.Overflow = v
+	}
+
+	v = os.Getenv("BROKER_SPILL_DIR")
+	if v != "" {
+		c.Broker.SpillDir = v
+	}
+
+	v = os.Getenv("BROKER_SPILL_MAX_SIZE")
+	if v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			c.Broker.SpillMaxSize = size
+		}
+	}
+
 	v = os.Getenv("PROMETHEUS_ADDRESS")
 	if v != "" {
 		c.Prometheus.Address = v
@@ -272,6 +533,29 @@ func (c *Config) LoadEnv() {
 		c.Prometheus.Endpoint = v
 	}
 
+	v = os.Getenv("ADMIN_ADDRESS")
+	if v != "" {
+		c.Admin.Address = v
+	}
+
+	v = os.Getenv("ADMIN_TOKEN")
+	if v != "" {
+		c.Admin.Token = v
+	}
+
+	v = os.Getenv("HEALTH_ADDRESS")
+	if v != "" {
+		c.Health.Address = v
+	}
+
+	v = os.Getenv("HEALTH_MIN_READY")
+	if v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			c.Health.MinReady = &f
+		}
+	}
+
 	v = os.Getenv("SHARD_STORE_TYPE")
 	if v != "" {
 		c.ShardStore.Type = v
@@ -282,6 +566,32 @@ func (c *Config) LoadEnv() {
 		c.ShardStore.Prefix = v
 	}
 
+	v = os.Getenv("SHARD_STORE_SESSION_TTL")
+	if v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err == nil {
+			c.ShardStore.SessionTTL = duration{ttl}
+		}
+	}
+
+	v = os.Getenv("SHARD_COORDINATOR_TYPE")
+	if v != "" {
+		c.ShardCoordinator.Type = v
+	}
+
+	v = os.Getenv("SHARD_COORDINATOR_PREFIX")
+	if v != "" {
+		c.ShardCoordinator.Prefix = v
+	}
+
+	v = os.Getenv("SHARD_COORDINATOR_LEASE_TTL")
+	if v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err == nil {
+			c.ShardCoordinator.LeaseTTL = duration{ttl}
+		}
+	}
+
 	v = os.Getenv("AMQP_URL")
 	if v != "" {
 		c.AMQP.URL = v
@@ -302,22 +612,58 @@ func (c *Config) LoadEnv() {
 	}
 }
 
+// Redacted returns a copy of the config with secrets removed
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Token != "" {
+		r.Token = redacted
+	}
+
+	if r.Admin.Token != "" {
+		r.Admin.Token = redacted
+	}
+
+	if u, err := url.Parse(r.AMQP.URL); err == nil {
+		r.AMQP.URL = u.Redacted()
+	}
+
+	r.Redis.URLs = make([]string, len(c.Redis.URLs))
+	for i, v := range c.Redis.URLs {
+		if u, err := url.Parse(v); err == nil {
+			v = u.Redacted()
+		}
+		r.Redis.URLs[i] = v
+	}
+
+	return &r
+}
+
 func (c *Config) String() string {
+	r := c.Redacted()
 	strs := []string{
 		fmt.Sprintf("Events:      %v", c.Events),
 		fmt.Sprintf("Intents:     %v", c.Intents),
 		fmt.Sprintf("Raw intents: %d", c.RawIntents),
+		fmt.Sprintf("Compression: %s", c.Compression),
+		fmt.Sprintf("Encoding:    %s", c.Encoding),
+		fmt.Sprintf("Raw ETF:     %t", c.RawETF),
 		fmt.Sprintf("Shard count: %d", c.Shards.Count),
 		fmt.Sprintf("Shard IDs:   %v", c.Shards.IDs),
+		fmt.Sprintf("Server:      %d/%d", c.Shards.ServerIndex, c.Shards.ServerCount),
+		fmt.Sprintf("Reserve:     %d", c.Shards.SessionStartReserve),
 		fmt.Sprintf("Broker:      %+v", c.Broker),
 		fmt.Sprintf("Shard store: %+v", c.ShardStore),
+		fmt.Sprintf("Coordinator: %+v", c.ShardCoordinator),
 		fmt.Sprintf("API:         %+v", c.API),
+		fmt.Sprintf("Shutdown:    %s", c.ShutdownTimeout),
 		fmt.Sprintf("Presence:    %+v", c.Presence),
 		fmt.Sprintf("Activities:  %+v", c.Presence.Activities),
 		"",
 		fmt.Sprintf("Prometheus:  %+v", c.Prometheus),
-		fmt.Sprintf("AMQP:        %+v", c.AMQP),
-		fmt.Sprintf("Redis:       %+v", c.Redis),
+		fmt.Sprintf("Admin:       %+v", r.Admin),
+		fmt.Sprintf("Health:      %+v", c.Health),
+		fmt.Sprintf("AMQP:        %+v", r.AMQP),
+		fmt.Sprintf("Redis:       %+v", r.Redis),
 	}
 
 	return strings.Join(strs, "\n")
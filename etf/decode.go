@@ -0,0 +1,449 @@
+// Package etf converts between the Erlang External Term Format used by the Discord gateway and JSON
+package etf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Term tags
+const (
+	tagVersion       = 131
+	tagNewFloat      = 70
+	tagSmallInteger  = 97
+	tagInteger       = 98
+	tagFloat         = 99
+	tagAtom          = 100
+	tagSmallTuple    = 104
+	tagLargeTuple    = 105
+	tagNil           = 106
+	tagString        = 107
+	tagList          = 108
+	tagBinary        = 109
+	tagSmallBig      = 110
+	tagLargeBig      = 111
+	tagMap           = 116
+	tagSmallAtom     = 115
+	tagAtomUTF8      = 118
+	tagSmallAtomUTF8 = 119
+
+	// maxSafeInteger is the largest integer that a JSON number can represent exactly
+	maxSafeInteger = 1<<53 - 1
+)
+
+// Errors
+var (
+	ErrInvalidVersion = errors.New("etf: invalid version")
+	ErrUnexpectedEnd  = errors.New("etf: unexpected end of data")
+	ErrTrailingData   = errors.New("etf: trailing data after term")
+)
+
+// UnsupportedTagError occurs when a term cannot be represented in JSON
+type UnsupportedTagError byte
+
+func (e UnsupportedTagError) Error() string {
+	return fmt.Sprintf("etf: unsupported tag %d", byte(e))
+}
+
+// ToJSON converts an ETF-encoded term to JSON. Atoms become strings, except nil, true and false;
+// tuples and lists become arrays; and binaries become strings. Integers that cannot be exactly
+// represented by a JSON number, such as snowflakes, become strings to match Discord's JSON
+// encoding.
+func ToJSON(data []byte) ([]byte, error) {
+	return AppendJSON(nil, data)
+}
+
+// AppendJSON converts an ETF-encoded term to JSON, appending it to dst
+func AppendJSON(dst, data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != tagVersion {
+		return dst, ErrInvalidVersion
+	}
+
+	d := decoder{data: data, pos: 1, out: dst}
+	if err := d.term(); err != nil {
+		return d.out, err
+	}
+
+	if d.pos != len(d.data) {
+		return d.out, ErrTrailingData
+	}
+	return d.out, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	out  []byte
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrUnexpectedEnd
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint8() (int, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return int(b[0]), nil
+}
+
+func (d *decoder) uint16() (int, error) {
+	b, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+func (d *decoder) uint32() (int, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// term converts the next term
+func (d *decoder) term() error {
+	tag, err := d.uint8()
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case tagSmallInteger:
+		n, err := d.uint8()
+		if err != nil {
+			return err
+		}
+		d.out = strconv.AppendInt(d.out, int64(n), 10)
+
+	case tagInteger:
+		b, err := d.read(4)
+		if err != nil {
+			return err
+		}
+		d.out = strconv.AppendInt(d.out, int64(int32(binary.BigEndian.Uint32(b))), 10)
+
+	case tagNewFloat:
+		b, err := d.read(8)
+		if err != nil {
+			return err
+		}
+		d.appendFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+
+	case tagFloat:
+		b, err := d.read(31)
+		if err != nil {
+			return err
+		}
+
+		end := 0
+		for end < len(b) && b[end] != 0 {
+			end++
+		}
+
+		f, err := strconv.ParseFloat(string(b[:end]), 64)
+		if err != nil {
+			return err
+		}
+		d.appendFloat(f)
+
+	case tagAtom, tagAtomUTF8:
+		n, err := d.uint16()
+		if err != nil {
+			return err
+		}
+		return d.atom(n)
+
+	case tagSmallAtom, tagSmallAtomUTF8:
+		n, err := d.uint8()
+		if err != nil {
+			return err
+		}
+		return d.atom(n)
+
+	case tagSmallTuple:
+		n, err := d.uint8()
+		if err != nil {
+			return err
+		}
+		return d.array(n, false)
+
+	case tagLargeTuple:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		return d.array(n, false)
+
+	case tagNil:
+		d.out = append(d.out, '[', ']')
+
+	case tagString:
+		n, err := d.uint16()
+		if err != nil {
+			return err
+		}
+
+		b, err := d.read(n)
+		if err != nil {
+			return err
+		}
+
+		d.out = append(d.out, '[')
+		for i, c := range b {
+			if i > 0 {
+				d.out = append(d.out, ',')
+			}
+			d.out = strconv.AppendInt(d.out, int64(c), 10)
+		}
+		d.out = append(d.out, ']')
+
+	case tagList:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		return d.array(n, true)
+
+	case tagBinary:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+
+		b, err := d.read(n)
+		if err != nil {
+			return err
+		}
+		d.out = appendString(d.out, b)
+
+	case tagSmallBig:
+		n, err := d.uint8()
+		if err != nil {
+			return err
+		}
+		return d.big(n)
+
+	case tagLargeBig:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		return d.big(n)
+
+	case tagMap:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+
+		d.out = append(d.out, '{')
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				d.out = append(d.out, ',')
+			}
+
+			if err := d.key(); err != nil {
+				return err
+			}
+			d.out = append(d.out, ':')
+
+			if err := d.term(); err != nil {
+				return err
+			}
+		}
+		d.out = append(d.out, '}')
+
+	default:
+		return UnsupportedTagError(tag)
+	}
+
+	return nil
+}
+
+// key converts the next term to a JSON object key
+func (d *decoder) key() error {
+	start := len(d.out)
+	if err := d.term(); err != nil {
+		return err
+	}
+
+	switch d.out[start] {
+	case '"':
+		return nil
+	case '{', '[':
+		return fmt.Errorf("etf: unsupported map key %s", d.out[start:])
+	}
+
+	// quote numbers and literals
+	key := string(d.out[start:])
+	d.out = appendString(d.out[:start], []byte(key))
+	return nil
+}
+
+func (d *decoder) atom(n int) error {
+	b, err := d.read(n)
+	if err != nil {
+		return err
+	}
+
+	switch string(b) {
+	case "nil", "null":
+		d.out = append(d.out, "null"...)
+	case "true", "false":
+		d.out = append(d.out, b...)
+	default:
+		d.out = appendString(d.out, b)
+	}
+	return nil
+}
+
+// array converts n terms to a JSON array; lists are followed by a tail, which is dropped if nil
+func (d *decoder) array(n int, list bool) error {
+	d.out = append(d.out, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			d.out = append(d.out, ',')
+		}
+
+		if err := d.term(); err != nil {
+			return err
+		}
+	}
+
+	if list {
+		if d.pos < len(d.data) && d.data[d.pos] == tagNil {
+			d.pos++
+		} else {
+			if n > 0 {
+				d.out = append(d.out, ',')
+			}
+
+			if err := d.term(); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.out = append(d.out, ']')
+	return nil
+}
+
+// big converts an n-byte little-endian integer
+func (d *decoder) big(n int) error {
+	sign, err := d.uint8()
+	if err != nil {
+		return err
+	}
+
+	b, err := d.read(n)
+	if err != nil {
+		return err
+	}
+
+	if n <= 8 {
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+
+		quote := v > maxSafeInteger
+		if quote {
+			d.out = append(d.out, '"')
+		}
+
+		if sign != 0 {
+			d.out = append(d.out, '-')
+		}
+		d.out = strconv.AppendUint(d.out, v, 10)
+
+		if quote {
+			d.out = append(d.out, '"')
+		}
+		return nil
+	}
+
+	be := make([]byte, n)
+	for i := range b {
+		be[n-1-i] = b[i]
+	}
+
+	v := new(big.Int).SetBytes(be)
+	if sign != 0 {
+		v.Neg(v)
+	}
+
+	d.out = append(d.out, '"')
+	d.out = v.Append(d.out, 10)
+	d.out = append(d.out, '"')
+	return nil
+}
+
+func (d *decoder) appendFloat(f float64) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		d.out = append(d.out, "null"...)
+		return
+	}
+	d.out = strconv.AppendFloat(d.out, f, 'g', -1, 64)
+}
+
+// appendString appends s as a JSON string, replacing invalid UTF-8
+func appendString(dst, s []byte) []byte {
+	const hex = "0123456789abcdef"
+
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,183 @@
+package etf
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// helpers encoding terms without the version byte
+
+func smallInt(n byte) []byte {
+	return []byte{tagSmallInteger, n}
+}
+
+func integer(n int32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{tagInteger}, uint32(n))
+}
+
+func newFloat(f float64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{tagNewFloat}, math.Float64bits(f))
+}
+
+func smallBig(sign byte, le ...byte) []byte {
+	return append([]byte{tagSmallBig, byte(len(le)), sign}, le...)
+}
+
+func uint64LE(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func atom(s string) []byte {
+	return append([]byte{tagAtom, 0, byte(len(s))}, s...)
+}
+
+func smallAtom(s string) []byte {
+	return append([]byte{tagSmallAtomUTF8, byte(len(s))}, s...)
+}
+
+func bin(s string) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{tagBinary}, uint32(len(s))), s...)
+}
+
+func list(elems ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{tagList}, uint32(len(elems)))
+	for _, e := range elems {
+		b = append(b, e...)
+	}
+	return append(b, tagNil)
+}
+
+func tuple(elems ...[]byte) []byte {
+	b := []byte{tagSmallTuple, byte(len(elems))}
+	for _, e := range elems {
+		b = append(b, e...)
+	}
+	return b
+}
+
+func dict(kvs ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{tagMap}, uint32(len(kvs)/2))
+	for _, e := range kvs {
+		b = append(b, e...)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func term(b []byte) []byte {
+	return append([]byte{tagVersion}, b...)
+}
+
+var toJSONTests = []struct {
+	name string
+	in   []byte
+	out  string
+}{
+	{"small integer", smallInt(42), `42`},
+	{"integer", integer(-70000), `-70000`},
+	{"new float", newFloat(1.5), `1.5`},
+	{"new float NaN", newFloat(math.NaN()), `null`},
+	{"float", append([]byte{tagFloat}, "1.50000000000000000000e+00\x00\x00\x00\x00\x00"...), `1.5`},
+	{"atom", atom("ok"), `"ok"`},
+	{"atom nil", atom("nil"), `null`},
+	{"small atom true", smallAtom("true"), `true`},
+	{"small atom false", smallAtom("false"), `false`},
+	{"small atom latin-1", []byte{tagSmallAtom, 4, 'n', 'u', 'l', 'l'}, `null`},
+	{"string", []byte{tagString, 0, 3, 1, 2, 3}, `[1,2,3]`},
+	{"binary", bin("héllo"), `"héllo"`},
+	{"binary escapes", bin("a\"b\\\n\r\t\x01"), `"a\"b\\\n\r\t\u0001"`},
+	{"binary invalid UTF-8", bin("a\xffb"), `"a\ufffdb"`},
+	{"small big", smallBig(0, 0x39, 0x30), `12345`},
+	{"small big negative", smallBig(1, 5), `-5`},
+	{"small big max safe", smallBig(0, uint64LE(maxSafeInteger)...), `9007199254740991`},
+	{"small big unsafe", smallBig(0, uint64LE(maxSafeInteger+2)...), `"9007199254740993"`},
+	{"snowflake", smallBig(0, uint64LE(175928847299117063)...), `"175928847299117063"`},
+	{"small big over 64 bits", smallBig(0, 0, 0, 0, 0, 0, 0, 0, 0, 1), `"18446744073709551616"`},
+	{"large big", append([]byte{tagLargeBig, 0, 0, 0, 9, 1}, 0, 0, 0, 0, 0, 0, 0, 0, 1), `"-18446744073709551616"`},
+	{"nil", []byte{tagNil}, `[]`},
+	{"list", list(smallInt(1), bin("a")), `[1,"a"]`},
+	{"improper list", concat([]byte{tagList, 0, 0, 0, 1}, smallInt(1), smallInt(2)), `[1,2]`},
+	{"tuple", tuple(smallInt(1), atom("b")), `[1,"b"]`},
+	{"large tuple", concat([]byte{tagLargeTuple, 0, 0, 0, 1}, smallInt(1)), `[1]`},
+	{"empty map", dict(), `{}`},
+	{"map", dict(bin("a"), smallInt(1), atom("b"), atom("nil")), `{"a":1,"b":null}`},
+	{"map integer key", dict(smallInt(1), smallInt(2)), `{"1":2}`},
+	{"map snowflake key", dict(smallBig(0, uint64LE(175928847299117063)...), atom("true")), `{"175928847299117063":true}`},
+	{"nested", dict(
+		bin("guilds"), list(dict(bin("id"), smallBig(0, uint64LE(175928847299117063)...), bin("roles"), []byte{tagNil})),
+		bin("d"), dict(bin("x"), list(list(newFloat(0.25)))),
+	), `{"guilds":[{"id":"175928847299117063","roles":[]}],"d":{"x":[[0.25]]}}`},
+}
+
+func TestToJSON(t *testing.T) {
+	for _, tt := range toJSONTests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := ToJSON(term(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(out) != tt.out {
+				t.Errorf("got %s, want %s", out, tt.out)
+			}
+		})
+	}
+}
+
+func TestToJSONTruncated(t *testing.T) {
+	for _, tt := range toJSONTests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := term(tt.in)
+			for n := 1; n < len(in); n++ {
+				if _, err := ToJSON(in[:n]); !errors.Is(err, ErrUnexpectedEnd) {
+					t.Fatalf("%d of %d bytes: got error %v, want %v", n, len(in), err, ErrUnexpectedEnd)
+				}
+			}
+		})
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"empty", nil, ErrInvalidVersion},
+		{"invalid version", []byte{130, tagNil}, ErrInvalidVersion},
+		{"trailing data", term(concat(smallInt(1), smallInt(2))), ErrTrailingData},
+		{"unsupported tag", term([]byte{tagNil + 100}), UnsupportedTagError(tagNil + 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ToJSON(tt.in); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := ToJSON(term(dict(list(smallInt(1)), smallInt(2)))); err == nil {
+		t.Error("expected error for list map key")
+	}
+}
+
+func TestAppendJSON(t *testing.T) {
+	out, err := AppendJSON([]byte("prefix:"), term(smallInt(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != "prefix:1" {
+		t.Errorf("got %s, want prefix:1", out)
+	}
+}
@@ -0,0 +1,174 @@
+package etf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// FromJSON converts JSON to an ETF-encoded term. Objects become maps with binary keys, arrays
+// become lists, strings become binaries, and null, true and false become atoms.
+func FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	e := encoder{dec: dec, out: []byte{tagVersion}}
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = e.value(tok); err != nil {
+		return nil, err
+	}
+	return e.out, nil
+}
+
+type encoder struct {
+	dec *json.Decoder
+	out []byte
+}
+
+// value encodes the value beginning with the given token
+func (e *encoder) value(tok json.Token) error {
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			return e.object()
+		}
+		return e.array()
+	case string:
+		e.binary(v)
+	case json.Number:
+		return e.number(v)
+	case bool:
+		if v {
+			e.atom("true")
+		} else {
+			e.atom("false")
+		}
+	case nil:
+		e.atom("nil")
+	}
+
+	return nil
+}
+
+func (e *encoder) object() error {
+	e.out = append(e.out, tagMap, 0, 0, 0, 0)
+	arity := len(e.out) - 4
+
+	n := 0
+	for ; e.dec.More(); n++ {
+		key, err := e.dec.Token()
+		if err != nil {
+			return err
+		}
+		e.binary(key.(string))
+
+		tok, err := e.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if err = e.value(tok); err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint32(e.out[arity:], uint32(n))
+	_, err := e.dec.Token()
+	return err
+}
+
+func (e *encoder) array() error {
+	e.out = append(e.out, tagList, 0, 0, 0, 0)
+	start := len(e.out) - 5
+
+	n := 0
+	for ; e.dec.More(); n++ {
+		tok, err := e.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if err = e.value(tok); err != nil {
+			return err
+		}
+	}
+
+	if n == 0 {
+		e.out = append(e.out[:start], tagNil)
+	} else {
+		binary.BigEndian.PutUint32(e.out[start+1:], uint32(n))
+		e.out = append(e.out, tagNil)
+	}
+
+	_, err := e.dec.Token()
+	return err
+}
+
+func (e *encoder) binary(s string) {
+	e.out = append(e.out, tagBinary)
+	e.out = binary.BigEndian.AppendUint32(e.out, uint32(len(s)))
+	e.out = append(e.out, s...)
+}
+
+func (e *encoder) atom(s string) {
+	e.out = append(e.out, tagSmallAtomUTF8, byte(len(s)))
+	e.out = append(e.out, s...)
+}
+
+func (e *encoder) number(n json.Number) error {
+	if i, err := n.Int64(); err == nil {
+		switch {
+		case i >= 0 && i <= math.MaxUint8:
+			e.out = append(e.out, tagSmallInteger, byte(i))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			e.out = append(e.out, tagInteger)
+			e.out = binary.BigEndian.AppendUint32(e.out, uint32(int32(i)))
+		default:
+			e.big(big.NewInt(i))
+		}
+		return nil
+	}
+
+	if i, ok := new(big.Int).SetString(string(n), 10); ok {
+		e.big(i)
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return err
+	}
+
+	e.out = append(e.out, tagNewFloat)
+	e.out = binary.BigEndian.AppendUint64(e.out, math.Float64bits(f))
+	return nil
+}
+
+// big encodes an integer as a little-endian magnitude with a sign
+func (e *encoder) big(i *big.Int) {
+	be := new(big.Int).Abs(i).Bytes()
+
+	if len(be) <= math.MaxUint8 {
+		e.out = append(e.out, tagSmallBig, byte(len(be)))
+	} else {
+		e.out = append(e.out, tagLargeBig)
+		e.out = binary.BigEndian.AppendUint32(e.out, uint32(len(be)))
+	}
+
+	if i.Sign() < 0 {
+		e.out = append(e.out, 1)
+	} else {
+		e.out = append(e.out, 0)
+	}
+
+	for j := len(be) - 1; j >= 0; j-- {
+		e.out = append(e.out, be[j])
+	}
+}
@@ -0,0 +1,88 @@
+package etf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  []byte
+	}{
+		{"small integer", `42`, smallInt(42)},
+		{"integer", `-70000`, integer(-70000)},
+		{"big", `123456789012`, smallBig(0, 0x14, 0x1a, 0x99, 0xbe, 0x1c)},
+		{"negative big", `-123456789012`, smallBig(1, 0x14, 0x1a, 0x99, 0xbe, 0x1c)},
+		{"over 64 bits", `18446744073709551616`, smallBig(0, 0, 0, 0, 0, 0, 0, 0, 0, 1)},
+		{"float", `1.5`, newFloat(1.5)},
+		{"string", `"a"`, bin("a")},
+		{"null", `null`, smallAtom("nil")},
+		{"true", `true`, smallAtom("true")},
+		{"empty array", `[]`, []byte{tagNil}},
+		{"array", `[1,"a"]`, list(smallInt(1), bin("a"))},
+		{"object", `{"a":{"b":[]}}`, dict(bin("a"), dict(bin("b"), []byte{tagNil}))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := FromJSON([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := term(tt.out); !bytes.Equal(out, want) {
+				t.Errorf("got %v, want %v", out, want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{"identify", `{"op":2,"d":{"token":"abc","intents":513,"properties":{"os":"linux"},"shard":[0,1],"presence":null}}`, ""},
+		{"heartbeat", `{"op":1,"d":null}`, ""},
+		{"numbers", `[0,255,256,-1,2147483647,-2147483648,2147483648,9007199254740991,0.5,-0.125]`, ""},
+		{"unicode", `{"content":"héllo 👋","name":"a\"b\\c\n"}`, ""},
+		{"nested", `{"a":[[],[{}],[[1,[2,[3]]]]],"b":{"c":{"d":{}}}}`, ""},
+		// integers that JSON numbers can't represent exactly come back as strings, like Discord's
+		{"snowflake number", `{"id":175928847299117063}`, `{"id":"175928847299117063"}`},
+		{"snowflake string", `{"id":"175928847299117063"}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term, err := FromJSON([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := ToJSON(term)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.out
+			if want == "" {
+				want = tt.in
+			}
+
+			if string(out) != want {
+				t.Errorf("got %s, want %s", out, want)
+			}
+		})
+	}
+}
+
+func TestFromJSONInvalid(t *testing.T) {
+	for _, in := range []string{``, `{`, `[1,`, `{"a"}`} {
+		if _, err := FromJSON([]byte(in)); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package etf
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// ErrInvalidPacket occurs when an ETF-encoded term is not a gateway packet
+var ErrInvalidPacket = errors.New("etf: invalid packet")
+
+// IsTerm returns whether data is ETF-encoded rather than JSON, which can't begin with the version
+// byte
+func IsTerm(data []byte) bool {
+	return len(data) != 0 && data[0] == tagVersion
+}
+
+// DecodePacket decodes an ETF-encoded gateway packet into p, reading its operation, sequence and
+// event without converting the packet to JSON first. The packet data is converted to JSON or, if
+// raw is set, copied as an ETF term. p's existing data buffer is reused.
+func DecodePacket(data []byte, p *types.ReceivePacket, raw bool) error {
+	if !IsTerm(data) {
+		return ErrInvalidVersion
+	}
+
+	d := decoder{data: data, pos: 1, out: p.Data[:0]}
+	tag, err := d.uint8()
+	if err != nil {
+		return err
+	}
+
+	if tag != tagMap {
+		return ErrInvalidPacket
+	}
+
+	n, err := d.uint32()
+	if err != nil {
+		return err
+	}
+
+	p.Op, p.Seq, p.Event = 0, 0, ""
+	found, start, end := false, 0, 0
+	for i := 0; i < n; i++ {
+		key, err := d.name()
+		if err != nil {
+			return err
+		}
+
+		switch string(key) {
+		case "op":
+			op, err := d.integer()
+			if err != nil {
+				return err
+			}
+			p.Op = types.GatewayOp(op)
+
+		case "s":
+			seq, err := d.integer()
+			if err != nil {
+				return err
+			}
+			p.Seq = types.Seq(seq)
+
+		case "t":
+			event, err := d.name()
+			if err != nil {
+				return err
+			}
+			p.Event = types.GatewayEvent(event)
+
+		case "d":
+			found = true
+			if !raw {
+				d.out = d.out[:0]
+				if err = d.term(); err != nil {
+					return err
+				}
+				break
+			}
+
+			start = d.pos
+			if err = d.skip(); err != nil {
+				return err
+			}
+			end = d.pos
+
+		default:
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.pos != len(d.data) {
+		return ErrTrailingData
+	}
+
+	switch {
+	case !found:
+		p.Data = append(d.out[:0], "null"...)
+	case raw:
+		p.Data = append(append(d.out[:0], tagVersion), data[start:end]...)
+	default:
+		p.Data = d.out
+	}
+	return nil
+}
+
+// name reads an atom or binary, returning nil for the nil atom
+func (d *decoder) name() ([]byte, error) {
+	tag, err := d.uint8()
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch tag {
+	case tagAtom, tagAtomUTF8:
+		n, err = d.uint16()
+	case tagSmallAtom, tagSmallAtomUTF8:
+		n, err = d.uint8()
+	case tagBinary:
+		n, err = d.uint32()
+	default:
+		return nil, ErrInvalidPacket
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag != tagBinary && (string(b) == "nil" || string(b) == "null") {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// integer reads a non-negative integer that fits in 64 bits, returning 0 for the nil atom
+func (d *decoder) integer() (uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, ErrUnexpectedEnd
+	}
+
+	switch d.data[d.pos] {
+	case tagSmallInteger:
+		d.pos++
+		n, err := d.uint8()
+		return uint64(n), err
+
+	case tagInteger:
+		d.pos++
+		b, err := d.read(4)
+		if err != nil {
+			return 0, err
+		}
+
+		n := int32(binary.BigEndian.Uint32(b))
+		if n < 0 {
+			return 0, ErrInvalidPacket
+		}
+		return uint64(n), nil
+
+	case tagSmallBig:
+		d.pos++
+		n, err := d.uint8()
+		if err != nil {
+			return 0, err
+		}
+
+		sign, err := d.uint8()
+		if err != nil {
+			return 0, err
+		}
+
+		b, err := d.read(n)
+		if err != nil {
+			return 0, err
+		}
+
+		if sign != 0 || n > 8 {
+			return 0, ErrInvalidPacket
+		}
+
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		return v, nil
+	}
+
+	name, err := d.name()
+	if err != nil || name != nil {
+		return 0, ErrInvalidPacket
+	}
+	return 0, nil
+}
+
+// skip skips the next term
+func (d *decoder) skip() error {
+	tag, err := d.uint8()
+	if err != nil {
+		return err
+	}
+
+	var n, elems int
+	switch tag {
+	case tagSmallInteger:
+		n = 1
+	case tagInteger:
+		n = 4
+	case tagNewFloat:
+		n = 8
+	case tagFloat:
+		n = 31
+	case tagNil:
+	case tagAtom, tagAtomUTF8, tagString:
+		n, err = d.uint16()
+	case tagSmallAtom, tagSmallAtomUTF8:
+		n, err = d.uint8()
+	case tagBinary:
+		n, err = d.uint32()
+	case tagSmallBig:
+		n, err = d.uint8()
+		n++
+	case tagLargeBig:
+		n, err = d.uint32()
+		n++
+	case tagSmallTuple:
+		elems, err = d.uint8()
+	case tagLargeTuple:
+		elems, err = d.uint32()
+	case tagList:
+		elems, err = d.uint32()
+		elems++
+	case tagMap:
+		elems, err = d.uint32()
+		elems *= 2
+	default:
+		return UnsupportedTagError(tag)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = d.read(n); err != nil {
+		return err
+	}
+
+	for i := 0; i < elems; i++ {
+		if err = d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
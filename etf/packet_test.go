@@ -0,0 +1,206 @@
+package etf
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// gatewayPackets returns JSON gateway packets resembling what a shard receives
+func gatewayPackets() map[string][]byte {
+	members := make([]string, 1000)
+	for i := range members {
+		id := strconv.Itoa(175928847299117063 + i)
+		members[i] = `{"user":{"id":"` + id + `","username":"user` + strconv.Itoa(i) + `","discriminator":"0","global_name":null,"avatar":"a_1269e74af4df7417b13759eae50c83dc","bot":false},"roles":["` + id + `","41771983423143936"],"joined_at":"2021-06-01T12:00:00.000000+00:00","deaf":false,"mute":false,"flags":0}`
+	}
+
+	return map[string][]byte{
+		"MESSAGE_CREATE": []byte(`{"op":0,"s":42,"t":"MESSAGE_CREATE","d":{"id":"1241604436327202866","guild_id":"41771983423143936","channel_id":"41771983423143937","author":{"id":"175928847299117063","username":"user","discriminator":"0","avatar":null,"bot":false},"content":"hello world, this is a message","timestamp":"2024-05-19T05:22:38.000000+00:00","tts":false,"mention_everyone":false,"mentions":[],"embeds":[],"attachments":[],"pinned":false,"type":0,"nonce":"1241604435911966720"}}`),
+		"GUILD_CREATE":   []byte(`{"op":0,"s":2,"t":"GUILD_CREATE","d":{"id":"41771983423143936","name":"Spectacles","member_count":1000,"large":true,"members":[` + strings.Join(members, ",") + `]}}`),
+		"HEARTBEAT_ACK":  []byte(`{"op":11,"d":null}`),
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	for name, packet := range gatewayPackets() {
+		t.Run(name, func(t *testing.T) {
+			want := new(types.ReceivePacket)
+			if err := json.Unmarshal(packet, want); err != nil {
+				t.Fatal(err)
+			}
+
+			term, err := FromJSON(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := new(types.ReceivePacket)
+			if err = DecodePacket(term, p, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if p.Op != want.Op || p.Seq != want.Seq || p.Event != want.Event {
+				t.Errorf("got op %d s %d t %q, want op %d s %d t %q", p.Op, p.Seq, p.Event, want.Op, want.Seq, want.Event)
+			}
+
+			if string(p.Data) != string(want.Data) {
+				t.Errorf("got data %s, want %s", p.Data, want.Data)
+			}
+
+			if err = DecodePacket(term, p, true); err != nil {
+				t.Fatal(err)
+			}
+
+			if !IsTerm(p.Data) {
+				t.Fatalf("raw data %v is not a term", p.Data)
+			}
+
+			data, err := ToJSON(p.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != string(want.Data) {
+				t.Errorf("got raw data %s, want %s", data, want.Data)
+			}
+		})
+	}
+}
+
+func TestDecodePacketFields(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want types.ReceivePacket
+	}{
+		{
+			"atoms",
+			dict(atom("t"), atom("READY"), atom("s"), integer(70000), atom("op"), smallInt(0), atom("d"), dict()),
+			types.ReceivePacket{Op: 0, Seq: 70000, Event: "READY", Data: json.RawMessage(`{}`)},
+		},
+		{
+			"nil sequence and event",
+			dict(atom("op"), smallInt(10), atom("s"), atom("nil"), atom("t"), atom("nil"), atom("d"), dict(atom("heartbeat_interval"), integer(41250))),
+			types.ReceivePacket{Op: 10, Data: json.RawMessage(`{"heartbeat_interval":41250}`)},
+		},
+		{
+			"big sequence",
+			dict(bin("op"), smallInt(0), bin("s"), smallBig(0, uint64LE(1<<40)...), bin("t"), bin("TYPING_START"), bin("d"), atom("nil")),
+			types.ReceivePacket{Op: 0, Seq: 1 << 40, Event: "TYPING_START", Data: json.RawMessage(`null`)},
+		},
+		{
+			"no data and unknown keys",
+			dict(atom("op"), smallInt(11), atom("x"), list(tuple(newFloat(1), atom("y")), dict(smallInt(1), []byte{tagString, 0, 1, 'a'}))),
+			types.ReceivePacket{Op: 11, Data: json.RawMessage(`null`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// reused packets must not keep fields of the previous packet
+			p := &types.ReceivePacket{Op: 1, Seq: 1, Event: "RESUMED", Data: json.RawMessage(`[1,2,3]`)}
+			if err := DecodePacket(term(tt.in), p, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if p.Op != tt.want.Op || p.Seq != tt.want.Seq || p.Event != tt.want.Event || string(p.Data) != string(tt.want.Data) {
+				t.Errorf("got %+v (%s), want %+v (%s)", p, p.Data, tt.want, tt.want.Data)
+			}
+		})
+	}
+}
+
+func TestDecodePacketInvalid(t *testing.T) {
+	valid := dict(atom("op"), smallInt(0), atom("s"), smallInt(1), atom("t"), atom("READY"), atom("d"), list(smallInt(1)))
+
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"invalid version", valid, ErrInvalidVersion},
+		{"not a map", term(list(smallInt(1))), ErrInvalidPacket},
+		{"list key", term(dict(list(), smallInt(0))), ErrInvalidPacket},
+		{"negative op", term(dict(atom("op"), integer(-1))), ErrInvalidPacket},
+		{"negative sequence", term(dict(atom("s"), smallBig(1, 1))), ErrInvalidPacket},
+		{"event list", term(dict(atom("t"), list(smallInt(1)))), ErrInvalidPacket},
+		{"unsupported tag", term(dict(atom("d"), []byte{tagNil + 100})), UnsupportedTagError(tagNil + 100)},
+		{"trailing data", append(term(valid), tagNil), ErrTrailingData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DecodePacket(tt.in, new(types.ReceivePacket), false); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	in := term(valid)
+	for n := 2; n < len(in); n++ {
+		for _, raw := range []bool{false, true} {
+			if err := DecodePacket(in[:n], new(types.ReceivePacket), raw); !errors.Is(err, ErrUnexpectedEnd) {
+				t.Fatalf("%d of %d bytes: got error %v, want %v", n, len(in), err, ErrUnexpectedEnd)
+			}
+		}
+	}
+}
+
+// The benchmarks below compare receiving a packet with the JSON encoding, with the ETF encoding
+// converted to JSON before being unmarshalled, and with the ETF encoding decoded directly with
+// and without converting the data to JSON.
+
+func benchmarkPackets(b *testing.B, etf bool, decode func(data []byte, p *types.ReceivePacket) error) {
+	for name, packet := range gatewayPackets() {
+		if etf {
+			var err error
+			if packet, err = FromJSON(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.Run(name, func(b *testing.B) {
+			p := new(types.ReceivePacket)
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if err := decode(packet, p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkJSON(b *testing.B) {
+	benchmarkPackets(b, false, func(data []byte, p *types.ReceivePacket) error {
+		return json.Unmarshal(data, p)
+	})
+}
+
+func BenchmarkToJSON(b *testing.B) {
+	var buf []byte
+	benchmarkPackets(b, true, func(data []byte, p *types.ReceivePacket) (err error) {
+		if buf, err = AppendJSON(buf[:0], data); err != nil {
+			return
+		}
+		return json.Unmarshal(buf, p)
+	})
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	benchmarkPackets(b, true, func(data []byte, p *types.ReceivePacket) error {
+		return DecodePacket(data, p, false)
+	})
+}
+
+func BenchmarkDecodePacketRaw(b *testing.B) {
+	benchmarkPackets(b, true, func(data []byte, p *types.ReceivePacket) error {
+		return DecodePacket(data, p, true)
+	})
+}
@@ -3,13 +3,17 @@ package gateway
 import (
 	"io"
 	"net/http"
-
-	"github.com/spec-tacles/go/types"
 )
 
 // DefaultVersion represents the default Gateway version
 const DefaultVersion uint = 10
 
+// Gateway payload encodings
+const (
+	EncodingJSON = "json"
+	EncodingETF  = "etf"
+)
+
 // Endpoints used for the Gateway
 const (
 	EndpointGateway    = "/gateway"
@@ -22,7 +26,7 @@ type REST interface {
 }
 
 // FetchGatewayBot fetches bot Gateway information
-func FetchGatewayBot(rest REST) (*types.GatewayBot, error) {
-	g := new(types.GatewayBot)
+func FetchGatewayBot(rest REST) (*GatewayBot, error) {
+	g := new(GatewayBot)
 	return g, rest.DoJSON(http.MethodGet, EndpointGatewayBot, nil, g)
 }
@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"io"
 	"sync"
 
 	"github.com/gorilla/websocket"
@@ -9,24 +10,28 @@ import (
 
 // Connection wraps a websocket connection
 type Connection struct {
-	ws         *websocket.Conn
-	compressor compression.Compressor
-	rmux       *sync.Mutex
-	wmux       *sync.Mutex
+	ws           *websocket.Conn
+	decompressor compression.Decompressor
+	compressor   compression.Compressor
+	rmux         *sync.Mutex
+	wmux         *sync.Mutex
 }
 
 // NewConnection creates a new ReadWriteCloser wrapper around a connection
-func NewConnection(conn *websocket.Conn, compressor compression.Compressor) (c *Connection) {
+func NewConnection(conn *websocket.Conn, decompressor compression.Decompressor) (c *Connection) {
 	return &Connection{
-		ws:         conn,
-		compressor: compressor,
-		rmux:       &sync.Mutex{},
-		wmux:       &sync.Mutex{},
+		ws:           conn,
+		decompressor: decompressor,
+		rmux:         &sync.Mutex{},
+		wmux:         &sync.Mutex{},
 	}
 }
 
 // CloseWithCode closes the connection with the specified code
 func (c *Connection) CloseWithCode(code int) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
 	return c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, "Normal Closure"))
 }
 
@@ -35,27 +40,47 @@ func (c *Connection) Close() error {
 	return c.CloseWithCode(websocket.CloseNormalClosure)
 }
 
-func (c *Connection) Write(d []byte) (int, error) {
-	// d = c.compressor.Compress(d)
+// Disconnect closes the underlying network connection without sending a close frame
+func (c *Connection) Disconnect() error {
+	if closer, ok := c.decompressor.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if closer, ok := c.compressor.(io.Closer); ok {
+		closer.Close()
+	}
 
+	return c.ws.Close()
+}
+
+// Write writes a message, compressing it if the connection compresses sent messages
+func (c *Connection) Write(d []byte) (int, error) {
 	c.wmux.Lock()
 	defer c.wmux.Unlock()
 
-	return len(d), c.ws.WriteMessage(websocket.BinaryMessage, d)
+	n := len(d)
+	if c.compressor != nil {
+		d = c.compressor.Compress(d)
+	}
+	return n, c.ws.WriteMessage(websocket.BinaryMessage, d)
 }
 
+// Read reads the next complete message, decompressing it if necessary
 func (c *Connection) Read() (d []byte, err error) {
 	c.rmux.Lock()
 	defer c.rmux.Unlock()
 
-	t, d, err := c.ws.ReadMessage()
-	if err != nil {
-		return
-	}
+	for {
+		var t int
+		t, d, err = c.ws.ReadMessage()
+		if err != nil || t != websocket.BinaryMessage {
+			return
+		}
 
-	if t == websocket.BinaryMessage {
-		d, err = c.compressor.Decompress(d)
+		// decompressors may buffer a message split across multiple frames
+		d, err = c.decompressor.Decompress(d)
+		if err != nil || len(d) > 0 {
+			return
+		}
 	}
-
-	return
 }
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// Envelope formats for published events
+const (
+	EnvelopeNone   = "none"
+	EnvelopeJSON   = "json"
+	EnvelopeBinary = "binary"
+)
+
+// envelopeVersion is the first byte of binary envelopes
+const envelopeVersion = 1
+
+// Envelope wraps a published event with the context it was received in
+type Envelope struct {
+	ShardID    int             `json:"shard_id"`
+	Seq        uint64          `json:"seq"`
+	Event      string          `json:"event"`
+	ReceivedAt time.Time       `json:"received_at"`
+	InstanceID string          `json:"instance_id"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// MarshalBinary encodes the envelope as a version byte, followed by the shard ID, sequence and
+// receive time in Unix nanoseconds as varints, the length-prefixed event name and instance ID,
+// and finally the event data.
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 1+4*binary.MaxVarintLen64+len(e.Event)+len(e.InstanceID)+len(e.Data))
+	b = append(b, envelopeVersion)
+	b = binary.AppendUvarint(b, uint64(e.ShardID))
+	b = binary.AppendUvarint(b, e.Seq)
+	b = binary.AppendVarint(b, e.ReceivedAt.UnixNano())
+	b = binary.AppendUvarint(b, uint64(len(e.Event)))
+	b = append(b, e.Event...)
+	b = binary.AppendUvarint(b, uint64(len(e.InstanceID)))
+	b = append(b, e.InstanceID...)
+	return append(b, e.Data...), nil
+}
+
+// UnmarshalBinary decodes an envelope encoded by MarshalBinary. Data refers to the given slice.
+func (e *Envelope) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 || b[0] != envelopeVersion {
+		return ErrInvalidEnvelope
+	}
+	b = b[1:]
+
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			b = nil
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+
+	str := func() (string, bool) {
+		n := uvarint()
+		if b == nil || uint64(len(b)) < n {
+			return "", false
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s, true
+	}
+
+	e.ShardID = int(uvarint())
+	e.Seq = uvarint()
+
+	nanos, n := binary.Varint(b)
+	if n <= 0 {
+		return ErrInvalidEnvelope
+	}
+	b = b[n:]
+	e.ReceivedAt = time.Unix(0, nanos)
+
+	var ok bool
+	if e.Event, ok = str(); !ok {
+		return ErrInvalidEnvelope
+	}
+	if e.InstanceID, ok = str(); !ok {
+		return ErrInvalidEnvelope
+	}
+
+	e.Data = b
+	return nil
+}
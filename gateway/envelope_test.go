@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		e    Envelope
+	}{
+		{"empty", Envelope{ReceivedAt: time.Unix(0, 0)}},
+		{"dispatch", Envelope{
+			ShardID:    3,
+			Seq:        42,
+			Event:      "MESSAGE_CREATE",
+			ReceivedAt: time.Unix(1700000000, 123456789),
+			InstanceID: "gateway-0",
+			Data:       []byte(`{"id":"81384788765712384"}`),
+		}},
+		{"large values", Envelope{
+			ShardID:    1<<31 - 1,
+			Seq:        1<<64 - 1,
+			Event:      "GUILD_CREATE",
+			ReceivedAt: time.Unix(0, -1),
+			Data:       bytes.Repeat([]byte("a"), 1<<16),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.e.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := Envelope{}
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.ShardID != tt.e.ShardID || got.Seq != tt.e.Seq || got.Event != tt.e.Event ||
+				!got.ReceivedAt.Equal(tt.e.ReceivedAt) || got.InstanceID != tt.e.InstanceID ||
+				!bytes.Equal(got.Data, tt.e.Data) {
+				t.Errorf("decoded %+v, want %+v", got, tt.e)
+			}
+
+			// every truncation of the header is rejected, while the data may be cut anywhere
+			header := len(b) - len(tt.e.Data)
+			for i := range b {
+				err := (&Envelope{}).UnmarshalBinary(b[:i])
+				if i < header && !errors.Is(err, ErrInvalidEnvelope) {
+					t.Errorf("decoding %d of %d header bytes returned %v, want %v", i, header, err, ErrInvalidEnvelope)
+				}
+				if i >= header && err != nil {
+					t.Errorf("decoding %d of %d data bytes returned %v", i-header, len(tt.e.Data), err)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvelopeBinaryInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"version", []byte{2, 0, 0, 0, 0, 0}},
+		{"unterminated varint", []byte{envelopeVersion, 0xff, 0xff}},
+		{"event too long", []byte{envelopeVersion, 0, 0, 0, 10, 'A'}},
+		{"event length overflow", []byte{envelopeVersion, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"instance ID too long", []byte{envelopeVersion, 0, 0, 0, 1, 'A', 5, 'b'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&Envelope{}).UnmarshalBinary(tt.b); !errors.Is(err, ErrInvalidEnvelope) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidEnvelope)
+			}
+		})
+	}
+}
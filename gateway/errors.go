@@ -9,4 +9,18 @@ var (
 	ErrMaxRetriesExceeded      = errors.New("max retries exceeded")
 	ErrReconnectReceived       = errors.New("received reconnect OP code")
 	ErrConnectionClosed        = errors.New("connection was closed")
+	ErrShuttingDown            = errors.New("shutting down")
+	ErrReconnectRequested      = errors.New("reconnect requested")
+	ErrReidentifyRequested     = errors.New("re-identify requested")
+	ErrShardNotFound           = errors.New("shard not found")
+	ErrManagerStopped          = errors.New("manager is not running")
+	ErrInvalidShardID          = errors.New("invalid shard ID")
+	ErrInvalidServerIndex      = errors.New("server index must be less than server count")
+	ErrUnsupportedEncoding     = errors.New("unsupported encoding")
+	ErrInvalidEnvelope         = errors.New("invalid envelope")
+	ErrSpillFull               = errors.New("spill buffer is full")
+	ErrSpillCorrupt            = errors.New("spill buffer is corrupt")
+	ErrReshardInProgress       = errors.New("resharding is already in progress")
+	ErrReshardUnsupported      = errors.New("resharding isn't supported with explicit shard IDs or shard leases")
+	ErrReshardAborted          = errors.New("resharding was aborted")
 )
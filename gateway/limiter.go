@@ -1,14 +1,16 @@
 package gateway
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// Limiter represents something that blocks until a ratelimit has been fulfilled
+// Limiter represents something that blocks until a ratelimit has been fulfilled. Lock returns the
+// context's error if it is cancelled first.
 type Limiter interface {
-	Lock()
+	Lock(ctx context.Context) error
 }
 
 // DefaultLimiter is a limiter that works locally
@@ -35,19 +37,80 @@ func NewDefaultLimiter(limit int32, duration time.Duration) Limiter {
 }
 
 // Lock establishes a ratelimited lock on the limiter
-func (l *DefaultLimiter) Lock() {
-	now := time.Now().UnixNano()
+func (l *DefaultLimiter) Lock(ctx context.Context) error {
+	for {
+		wait := l.take()
+		if wait == 0 {
+			return nil
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// take consumes a lock if one is available, otherwise returning how long until the limit resets
+func (l *DefaultLimiter) take() time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 
+	now := time.Now().UnixNano()
 	if atomic.LoadInt64(l.resetsAt) <= now {
 		atomic.StoreInt64(l.resetsAt, now+atomic.LoadInt64(l.duration))
 		atomic.StoreInt32(l.available, atomic.LoadInt32(l.limit))
 	}
 
-	if atomic.LoadInt32(l.available) <= 0 {
-		time.Sleep(time.Duration(atomic.LoadInt64(l.resetsAt) - now))
-		l.Lock()
-		return
+	if atomic.LoadInt32(l.available) > 0 {
+		atomic.AddInt32(l.available, -1)
+		return 0
 	}
+	return time.Duration(atomic.LoadInt64(l.resetsAt) - now)
+}
+
+// limiterChain locks each of its limiters in order
+type limiterChain []Limiter
+
+func (c limiterChain) Lock(ctx context.Context) error {
+	for _, l := range c {
+		if err := l.Lock(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BucketLimiter ratelimits identifies according to Discord's max_concurrency: shards are grouped
+// into buckets keyed by shard_id % max_concurrency, and each bucket is limited independently
+type BucketLimiter struct {
+	buckets []Limiter
+}
+
+// NewBucketLimiter creates a bucket limiter with the given concurrency, allowing one lock per
+// bucket per duration
+func NewBucketLimiter(concurrency int, duration time.Duration) *BucketLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	buckets := make([]Limiter, concurrency)
+	for i := range buckets {
+		buckets[i] = NewDefaultLimiter(1, duration)
+	}
+
+	return &BucketLimiter{buckets}
+}
+
+// Bucket returns the limiter responsible for the given shard
+func (l *BucketLimiter) Bucket(shardID int) Limiter {
+	return l.buckets[shardID%len(l.buckets)]
+}
 
-	atomic.AddInt32(l.available, -1)
+// Concurrency returns the number of buckets in this limiter
+func (l *BucketLimiter) Concurrency() int {
+	return len(l.buckets)
 }
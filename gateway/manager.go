@@ -1,11 +1,17 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/gateway/etf"
 	"github.com/spec-tacles/gateway/stats"
 	"github.com/spec-tacles/go/broker"
 	"github.com/spec-tacles/go/types"
@@ -17,218 +23,593 @@ type RepublishPacket struct {
 	Packet  *types.SendPacket
 }
 
+// identifyInterval is the time each identify bucket waits between identifies
+// this is supposed to be 5s, but 5s causes every other session to be invalidated
+const identifyInterval = 5250 * time.Millisecond
+
 // Manager manages Gateway shards
 type Manager struct {
+	// Shards contains every shard spawned by this manager; use Shard for concurrent access
 	Shards      map[int]*Shard
-	Gateway     *types.GatewayBot
+	Gateway     *GatewayBot
 	opts        *ManagerOptions
 	gatewayLock sync.Mutex
+
+	shardsMu   sync.RWMutex
+	ids        []int
+	runs       map[int]*shardRun
+	set        *shardSet
+	resharding bool
+	presence   atomic.Pointer[types.StatusUpdate]
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// running counts the goroutines Start waits for. It's only changed with the shards lock held,
+	// so that none are started once Start has stopped waiting.
+	running int
+	idle    sync.Cond
+	stopped bool
+
+	buckets      *BucketLimiter
+	sessions     *sessionLimiter
+	limitersOnce sync.Once
+
+	publishes sync.WaitGroup
+	members   memberRequests
+	sub       *subscription
+	subMu     sync.Mutex
 }
 
 // NewManager creates a new Gateway manager
 func NewManager(opts *ManagerOptions) *Manager {
 	opts.init()
 
-	return &Manager{
+	m := &Manager{
 		Shards:      make(map[int]*Shard),
+		runs:        make(map[int]*shardRun),
 		opts:        opts,
 		gatewayLock: sync.Mutex{},
 	}
+	m.idle.L = &m.shardsMu
+	m.presence.Store(opts.ShardOptions.Identify.Presence)
+	return m
 }
 
-// Start starts all shards
+// Start starts all shards and blocks until they have all stopped, along with the resharding checks
+// if enabled. Shards can't be restarted once Start has returned.
 func (m *Manager) Start(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.shardsMu.Lock()
+	m.ctx, m.cancel = ctx, cancel
+	m.shardsMu.Unlock()
+
+	g, err := m.FetchGateway()
+	if err != nil {
+		m.log(LogLevelError, "Failed to fetch gateway info: %s", err)
+		return
+	}
+
 	if m.opts.ShardCount == 0 {
 		m.log(LogLevelDebug, "Shard count unspecified: using Discord recommended value")
+		m.opts.ShardCount = g.Shards
+	}
 
-		var g *types.GatewayBot
-		g, err = m.FetchGateway()
-		if err != nil {
-			m.log(LogLevelError, "Failed to fetch gateway info", err)
-			return
+	ids, err := m.shardIDs(m.opts.ShardCount)
+	if err != nil {
+		return
+	}
+
+	if m.opts.ShardCoordinator != nil {
+		m.log(LogLevelInfo, "Leasing %d shard(s) out of %d total", len(ids), m.opts.ShardCount)
+	} else {
+		m.log(LogLevelInfo, "Starting %d shard(s) out of %d total", len(ids), m.opts.ShardCount)
+		m.setShardIDs(ids)
+	}
+
+	m.shardsMu.Lock()
+	set := m.currentSet()
+	m.set = set
+
+	if m.opts.ShardCoordinator != nil {
+		m.track()
+		go m.coordinate(set, ids)
+	} else {
+		for _, id := range ids {
+			m.runShard(set, id)
 		}
+	}
 
-		m.opts.ShardCount = g.Shards
+	if m.opts.ReshardInterval > 0 {
+		m.track()
+		go m.checkShardCount(ctx)
 	}
 
-	expected := m.opts.ShardCount / m.opts.ServerCount
-	if m.opts.ServerIndex < (m.opts.ShardCount % m.opts.ServerCount) {
-		expected++
+	for m.running > 0 {
+		m.idle.Wait()
 	}
+	m.stopped = true
+	m.shardsMu.Unlock()
+	return
+}
 
-	m.log(LogLevelInfo, "Starting %d shard(s) out of %d total", expected, m.opts.ShardCount)
+// track records that a goroutine Start waits for is starting, unless Start has already returned;
+// the shards lock must be held
+func (m *Manager) track() bool {
+	if m.stopped {
+		return false
+	}
 
-	wg := sync.WaitGroup{}
-	for i := m.opts.ServerIndex; i < m.opts.ShardCount; i += m.opts.ServerCount {
-		id := i
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	m.running++
+	return true
+}
 
-			stats.TotalShards.Add(1)
-			defer stats.TotalShards.Sub(1)
+// untrack records that a goroutine started after track has finished
+func (m *Manager) untrack() {
+	m.shardsMu.Lock()
+	defer m.shardsMu.Unlock()
 
-			err := m.Spawn(ctx, id)
-			if err != nil {
-				m.log(LogLevelError, "Fatal error in shard %d: %s", id, err)
-			} else {
-				m.log(LogLevelDebug, "Shard %d closing gracefully", id)
-			}
-		}()
+	if m.running--; m.running == 0 {
+		m.idle.Broadcast()
 	}
+}
 
-	wg.Wait()
-	return
+// runShard runs the given shard of a set in the background and returns whether it was started;
+// the shards lock must be held
+func (m *Manager) runShard(set *shardSet, id int) bool {
+	if !m.track() {
+		return false
+	}
+
+	set.wg.Add(1)
+	set.running[id] = struct{}{}
+	go m.run(set, id)
+	return true
+}
+
+// run spawns the given shard and waits for it to stop
+func (m *Manager) run(set *shardSet, id int) {
+	defer m.untrack()
+	defer set.wg.Done()
+	defer func() {
+		m.shardsMu.Lock()
+		delete(set.running, id)
+		m.shardsMu.Unlock()
+	}()
+
+	stats.TotalShards.Add(1)
+	defer stats.TotalShards.Sub(1)
+
+	err := m.spawn(set.ctx, id, set)
+	switch {
+	case websocket.IsCloseError(err, types.CloseShardingRequired):
+		m.log(LogLevelError, "Shard %d closed because Discord requires more than %d shard(s)", id, set.count)
+		m.shardsMu.Lock()
+		if m.track() {
+			go m.reshardRequired(set)
+		}
+		m.shardsMu.Unlock()
+	case err != nil:
+		m.log(LogLevelError, "Fatal error in shard %d: %s", id, err)
+	default:
+		m.log(LogLevelDebug, "Shard %d closing gracefully", id)
+	}
+}
+
+// shardIDs returns the IDs of the shards this manager is responsible for out of the given total
+func (m *Manager) shardIDs(count int) (ids []int, err error) {
+	if len(m.opts.ShardIDs) == 0 {
+		if m.opts.ServerIndex < 0 || m.opts.ServerIndex >= m.opts.ServerCount {
+			return nil, ErrInvalidServerIndex
+		}
+
+		for id := m.opts.ServerIndex; id < count; id += m.opts.ServerCount {
+			ids = append(ids, id)
+		}
+		return
+	}
+
+	seen := make(map[int]struct{}, len(m.opts.ShardIDs))
+	for _, id := range m.opts.ShardIDs {
+		if id < 0 || id >= count {
+			return nil, fmt.Errorf("%w: %d is out of range for %d shard(s)", ErrInvalidShardID, id, count)
+		}
+
+		if _, ok := seen[id]; ok {
+			return nil, fmt.Errorf("%w: %d is specified more than once", ErrInvalidShardID, id)
+		}
+		seen[id] = struct{}{}
+	}
+
+	return m.opts.ShardIDs, nil
 }
 
 // Spawn a new shard with the specified ID
 func (m *Manager) Spawn(ctx context.Context, id int) (err error) {
+	m.shardsMu.RLock()
+	set := m.currentSet()
+	m.shardsMu.RUnlock()
+
+	return m.spawn(ctx, id, set)
+}
+
+// spawn spawns a shard of the given set
+func (m *Manager) spawn(ctx context.Context, id int, set *shardSet) (err error) {
 	g, err := m.FetchGateway()
 	if err != nil {
 		return
 	}
 
 	opts := m.opts.ShardOptions.clone()
-	opts.Identify.Shard = []int{id, m.opts.ShardCount}
+	opts.Identify.Shard = []int{id, set.count}
 	opts.LogLevel = m.opts.LogLevel
-	opts.IdentifyLimiter = m.opts.ShardLimiter
+	opts.IdentifyLimiter = m.identifyLimiter(id, g)
+	opts.presence = &m.presence
 	if opts.Logger == nil {
 		opts.Logger = m.opts.Logger
 	}
 
+	if set.store != nil {
+		opts.Store = set.store
+	}
+
+	// a shard whose lease was lost mustn't overwrite the session of the process that took it over
+	if c := m.opts.ShardCoordinator; c != nil {
+		opts.leased = func(ctx context.Context) bool {
+			ok, err := c.Renew(ctx, id)
+			return ok && err == nil
+		}
+	}
+
+	var s *Shard
 	if m.opts.OnPacket != nil {
+		// only the current shard with this ID forwards packets, so that a set of shards being
+		// started or stopped while resharding doesn't publish events twice
 		opts.OnPacket = func(r *types.ReceivePacket) {
-			m.opts.OnPacket(id, r)
+			if m.Shard(id) == s {
+				m.opts.OnPacket(id, r)
+			}
+		}
+	}
+
+	if m.opts.OnStateChange != nil {
+		opts.OnStateChange = func(old, new ShardState) {
+			m.opts.OnStateChange(id, old, new)
 		}
 	}
 
-	s := NewShard(opts)
+	s = NewShard(opts)
 	s.Gateway = g
-	m.Shards[id] = s
 
-	err = s.Open(ctx)
-	if err != nil {
-		return
+	m.shardsMu.Lock()
+	set.shards[id] = s
+	m.shardsMu.Unlock()
+
+	for {
+		shardCtx, cancel := context.WithCancel(ctx)
+		m.startRun(set, id, cancel)
+
+		err = s.Open(shardCtx)
+		cancel()
+
+		if !m.finishRun(set, id) || ctx.Err() != nil {
+			return
+		}
+		m.log(LogLevelInfo, "Restarting shard %d", id)
 	}
+}
 
-	return s.Close()
+// identifyLimiter returns the limiter the given shard must lock before identifying. Shards in
+// different max_concurrency buckets identify in parallel, and all identifies are counted against
+// the daily session start limit; resumes never lock it.
+func (m *Manager) identifyLimiter(id int, g *GatewayBot) Limiter {
+	m.limitersOnce.Do(func() {
+		m.sessions = newSessionLimiter(m, g)
+		m.buckets = NewBucketLimiter(g.SessionStartLimit.MaxConcurrency, identifyInterval)
+		m.log(LogLevelInfo, "Identifying with max concurrency %d", m.buckets.Concurrency())
+	})
+
+	if m.opts.ShardLimiter != nil {
+		return limiterChain{m.sessions, m.opts.ShardLimiter}
+	}
+	return limiterChain{m.sessions, m.buckets.Bucket(id)}
 }
 
 // FetchGateway fetches the gateway or from cache
-func (m *Manager) FetchGateway() (g *types.GatewayBot, err error) {
+func (m *Manager) FetchGateway() (g *GatewayBot, err error) {
 	m.gatewayLock.Lock()
 	defer m.gatewayLock.Unlock()
 
 	if m.Gateway != nil {
 		g = m.Gateway
-	} else {
-		g, err = FetchGatewayBot(m.opts.REST)
-		m.log(LogLevelDebug, "Loaded gateway info %+v", g)
-		m.Gateway = g
+		return
 	}
+
+	return m.fetchGateway()
+}
+
+// refreshGateway fetches the gateway, bypassing the cache
+func (m *Manager) refreshGateway() (g *GatewayBot, err error) {
+	m.gatewayLock.Lock()
+	defer m.gatewayLock.Unlock()
+
+	return m.fetchGateway()
+}
+
+// fetchGateway fetches the gateway and caches it; the gateway lock must be held
+func (m *Manager) fetchGateway() (g *GatewayBot, err error) {
+	g, err = FetchGatewayBot(m.opts.REST)
+	if err != nil {
+		return
+	}
+
+	m.log(LogLevelDebug, "Loaded gateway info %+v", g)
+	m.Gateway = g
 	return
 }
 
 // ConnectBroker connects a broker to this manager. It forwards all packets from the gateway and
-// consumes packets from the broker for all shards it's responsible for.
+// consumes packets from the broker for all shards it's responsible for, subscribing once those
+// shards are known and again whenever they change. Brokers must stop delivering messages once a
+// subscription's context is cancelled. Packets received while shutting down are still published;
+// use Drain to wait for them.
 func (m *Manager) ConnectBroker(ctx context.Context, b broker.Broker, events map[string]struct{}) {
-	ch := make(chan broker.Message)
 	if b == nil {
 		return
 	}
+	ch := make(chan broker.Message)
 
+	q := newPublishQueue(context.WithoutCancel(ctx), m, b)
 	m.opts.OnPacket = func(shard int, d *types.ReceivePacket) {
 		if d.Op != types.GatewayOpDispatch {
 			return
 		}
 
+		if d.Event == "GUILD_MEMBERS_CHUNK" {
+			if data, err := jsonData(d.Data); err != nil {
+				m.log(LogLevelWarn, "unable to read guild members chunk: %s", err)
+			} else {
+				m.replyMembers(q, data)
+			}
+		}
+
 		if _, ok := events[string(d.Event)]; !ok {
 			return
 		}
 
-		err := b.Publish(ctx, string(d.Event), d.Data)
+		data, err := m.envelope(shard, d)
 		if err != nil {
-			m.log(LogLevelError, "failed to publish packet to broker: %s", err)
+			m.log(LogLevelError, "failed to wrap packet in envelope: %s", err)
+			return
 		}
+
+		m.enqueue(q, shard, d, data)
 	}
 
 	go func() {
 		for msg := range ch {
 			m.handleMessage(ctx, b, msg)
+
+			err := msg.Ack(ctx)
+			if err != nil {
+				m.log(LogLevelWarn, "failed to acknowledge %s message: %s", msg.Event(), err)
+			}
 		}
 	}()
 
-	eventList := make([]string, len(m.Shards)+1)
-	eventList = append(eventList, "SEND")
-	for id := range m.Shards {
-		eventList = append(eventList, strconv.FormatInt(int64(id), 10))
+	m.subMu.Lock()
+	if m.sub != nil {
+		for _, cancel := range m.sub.topics {
+			cancel()
+		}
 	}
+	m.sub = &subscription{broker: b, ctx: ctx, messages: ch, queue: q}
+	m.subMu.Unlock()
 
-	go b.Subscribe(ctx, eventList, ch)
+	m.resubscribe()
 }
 
-func (m *Manager) handleMessage(ctx context.Context, b broker.Broker, msg broker.Message) {
-	var (
-		shard  *Shard
-		packet *types.SendPacket
-	)
+// enqueue queues a dispatch to be published. If a partition key is configured, events are
+// published with their key by brokers that support it, or otherwise under the event of their
+// partition, and are published in order per key; otherwise they're published in order per shard.
+func (m *Manager) enqueue(q *publishQueue, shard int, d *types.ReceivePacket, data []byte) {
+	p := &publication{event: string(d.Event), data: data}
+	if q.partitionKey == "" {
+		q.push(strconv.Itoa(shard), p)
+		return
+	}
+
+	data, err := jsonData(d.Data)
+	if err != nil {
+		m.log(LogLevelWarn, "unable to read partition key of %s: %s", d.Event, err)
+	}
+
+	p.key = partitionKey(data, q.partitionKey)
+	p.partitions = m.opts.Partitions
+	q.push(p.key, p)
+}
+
+// envelope returns the data to publish for a dispatch in the configured envelope format
+func (m *Manager) envelope(shard int, d *types.ReceivePacket) ([]byte, error) {
+	if m.opts.Envelope == EnvelopeNone {
+		// packets are reused once OnPacket returns
+		return bytes.Clone(d.Data), nil
+	}
+
+	e := &Envelope{
+		ShardID:    shard,
+		Seq:        uint64(d.Seq),
+		Event:      string(d.Event),
+		ReceivedAt: time.Now(),
+		InstanceID: m.opts.InstanceID,
+		Data:       d.Data,
+	}
+
+	if m.opts.Envelope == EnvelopeBinary {
+		return e.MarshalBinary()
+	}
+
+	// JSON envelopes can only hold JSON data
+	data, err := jsonData(d.Data)
+	if err != nil {
+		return nil, err
+	}
 
+	e.Data = data
+	return json.Marshal(e)
+}
+
+// jsonData returns the data of a packet as JSON, converting it if it was left ETF-encoded
+func jsonData(data json.RawMessage) (json.RawMessage, error) {
+	if !etf.IsTerm(data) {
+		return data, nil
+	}
+	return etf.ToJSON(data)
+}
+
+// replyMembers publishes a guild members chunk to the event named by its request
+func (m *Manager) replyMembers(q *publishQueue, data json.RawMessage) {
+	replyTo, payloads, err := m.members.handle(data)
+	if err != nil {
+		m.log(LogLevelWarn, "unable to handle guild members chunk: %s", err)
+		return
+	}
+
+	for _, d := range payloads {
+		q.push(replyTo, &publication{event: replyTo, data: d})
+	}
+}
+
+// Drain waits for packets that are queued or being published to the broker, or until the context
+// is done. Packets that were spilled are then synced to disk.
+func (m *Manager) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.publishes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return m.closeSpill()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) handleMessage(ctx context.Context, b broker.Broker, msg broker.Message) {
 	if msg.Event() == "SEND" {
-		p := &UnknownSendPacket{}
-		switch body := msg.Body().(type) {
-		case []byte:
-			err := json.Unmarshal(body, p)
-			if err != nil {
-				m.log(LogLevelWarn, "unable to parse SEND packet: %s", err)
-				return
-			}
-		default:
-			m.log(LogLevelWarn, "unexpected SEND packet type %T", body)
-			return
-		}
+		m.routeMessage(ctx, b, msg)
+		return
+	}
 
-		shardID := int(p.GuildID >> 22 % uint64(m.opts.ShardCount))
-		shard = m.Shards[shardID]
-		if shard == nil {
-			data, err := json.Marshal(p.Packet)
-			if err != nil {
-				m.log(LogLevelError, "error serializing SEND packet data (%+v): %s", *p.Packet, err)
-				return
-			}
+	shardID, err := strconv.Atoi(msg.Event())
+	if err != nil {
+		m.log(LogLevelWarn, "received unexpected non-int event from broker: %s", err)
+		return
+	}
+	shard := m.Shard(shardID)
+	if shard == nil {
+		m.log(LogLevelWarn, "received event for shard %d which does not exist", shardID)
+		return
+	}
 
-			err = b.Publish(ctx, strconv.Itoa(shardID), data)
-			if err != nil {
-				m.log(LogLevelError, "error re-publishing SEND packet data to shard %d: %s", shardID, err)
-			}
-			return
+	// packets are re-published with their reply context, but may also be published directly
+	p := &UnknownSendPacket{}
+	switch body := msg.Body().(type) {
+	case []byte:
+		err = json.Unmarshal(body, p)
+		if err == nil && p.Packet == nil {
+			p.Packet = &types.SendPacket{}
+			err = json.Unmarshal(body, p.Packet)
 		}
-		packet = p.Packet
-	} else {
-		shardID, err := strconv.Atoi(msg.Event())
+
 		if err != nil {
-			m.log(LogLevelWarn, "received unexpected non-int event from AMQP: %s", err)
+			m.log(LogLevelWarn, "unable to parse packet intended for shard %d: %s", shardID, err)
+			return
 		}
-		shard = m.Shards[shardID]
-		if shard == nil {
-			m.log(LogLevelWarn, "received event for shard %d which does not exist", shardID)
+	default:
+		m.log(LogLevelWarn, "unexpected packet type %T", body)
+		return
+	}
+
+	m.send(shard, p)
+}
+
+// routeMessage sends a SEND packet to the shards chosen by the shard router. Packets for shards
+// that this manager isn't running are re-published to the shard's event for another gateway
+// instance to send.
+func (m *Manager) routeMessage(ctx context.Context, b broker.Broker, msg broker.Message) {
+	p := &UnknownSendPacket{}
+	switch body := msg.Body().(type) {
+	case []byte:
+		err := json.Unmarshal(body, p)
+		if err != nil {
+			m.log(LogLevelWarn, "unable to parse SEND packet: %s", err)
 			return
 		}
+	default:
+		m.log(LogLevelWarn, "unexpected SEND packet type %T", body)
+		return
+	}
+
+	if p.Packet == nil {
+		m.log(LogLevelWarn, "received SEND packet without a packet to send")
+		return
+	}
+
+	count := m.shardCount()
+	if count == 0 {
+		m.log(LogLevelWarn, "received SEND packet before the shard count is known")
+		return
+	}
+
+	ids, err := m.opts.ShardRouter.Route(p, count)
+	if err != nil {
+		m.log(LogLevelWarn, "unable to route SEND packet: %s", err)
+		return
+	}
 
-		switch body := msg.Body().(type) {
-		case []byte:
-			err := json.Unmarshal(body, packet)
+	var data []byte
+	for _, id := range ids {
+		shard := m.Shard(id)
+		if shard != nil {
+			m.send(shard, p)
+			continue
+		}
+
+		if data == nil {
+			data, err = json.Marshal(&UnknownSendPacket{
+				Packet:    p.Packet,
+				ReplyTo:   p.ReplyTo,
+				Aggregate: p.Aggregate,
+			})
 			if err != nil {
-				m.log(LogLevelWarn, "unable to parse packet intended for shard %d: %s", shardID, err)
+				m.log(LogLevelError, "error serializing SEND packet data (%+v): %s", *p.Packet, err)
 				return
 			}
-		default:
-			m.log(LogLevelWarn, "unexpected packet type %T", body)
-			return
+		}
+
+		err = b.Publish(ctx, strconv.Itoa(id), data)
+		if err != nil {
+			m.log(LogLevelError, "error re-publishing SEND packet data to shard %d: %s", id, err)
+		}
+	}
+}
+
+// send sends a packet through a shard, tracking its reply if it's a guild members request
+func (m *Manager) send(shard *Shard, p *UnknownSendPacket) {
+	packet := p.Packet
+	if p.ReplyTo != "" {
+		var ok bool
+		if packet, ok = m.members.track(p.Packet, p.ReplyTo, p.Aggregate); !ok {
+			m.log(LogLevelWarn, "ignoring reply_to for packet (%d) which isn't a guild members request", p.Packet.Op)
 		}
 	}
 
 	err := shard.Send(packet)
 	if err != nil {
-		m.log(LogLevelError, "error sending packet (%d): %s", packet.Op, err)
+		m.log(LogLevelError, "error sending packet (%d) to shard %d: %s", p.Packet.Op, shard.ID(), err)
 	}
 }
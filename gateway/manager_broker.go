@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/spec-tacles/go/broker"
+)
+
+// subscription is the manager's current broker subscription
+type subscription struct {
+	broker   broker.Broker
+	ctx      context.Context
+	messages chan broker.Message
+	queue    *publishQueue
+
+	// topics holds the topics subscribed to, along with the function cancelling each subscription
+	topics map[string]context.CancelFunc
+}
+
+// setShardIDs records the shards this manager is responsible for and subscribes to their events
+func (m *Manager) setShardIDs(ids []int) {
+	m.shardsMu.Lock()
+	m.ids = append([]int{}, ids...)
+	slices.Sort(m.ids)
+	m.shardsMu.Unlock()
+
+	m.resubscribe()
+}
+
+// resubscribe subscribes to SEND packets and the events of the shards this manager is responsible
+// for, updating the subscription if those shards have changed. Nothing is subscribed until the
+// shards are known.
+//
+// Each topic is subscribed to separately and only its subscription is cancelled once it's no
+// longer needed, since brokers such as AMQP don't support cancelling a subscription to several
+// topics. RWBrokers are only subscribed to once, since they keep reading their input after their
+// subscription is cancelled.
+func (m *Manager) resubscribe() {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	sub := m.sub
+	if sub == nil {
+		return
+	}
+
+	m.shardsMu.RLock()
+	if m.ids == nil {
+		m.shardsMu.RUnlock()
+		return
+	}
+
+	events := make([]string, 0, len(m.ids)+1)
+	events = append(events, "SEND")
+	for _, id := range m.ids {
+		events = append(events, strconv.Itoa(id))
+	}
+	m.shardsMu.RUnlock()
+
+	if _, ok := sub.broker.(*broker.RWBroker); ok {
+		if sub.topics == nil {
+			sub.topics = make(map[string]context.CancelFunc, len(events))
+			for _, e := range events {
+				sub.topics[e] = func() {}
+			}
+			m.subscribe(sub.ctx, sub, events)
+		} else if !subscribedTo(sub.topics, events) {
+			m.log(LogLevelWarn, "unable to update subscription to %v: the broker can only be subscribed to once", events)
+		}
+		return
+	}
+
+	if sub.topics == nil {
+		sub.topics = make(map[string]context.CancelFunc, len(events))
+	}
+
+	for topic, cancel := range sub.topics {
+		if !slices.Contains(events, topic) {
+			m.log(LogLevelDebug, "Unsubscribing from %s", topic)
+			cancel()
+			delete(sub.topics, topic)
+		}
+	}
+
+	for _, e := range events {
+		if _, ok := sub.topics[e]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(sub.ctx)
+		sub.topics[e] = cancel
+		m.subscribe(ctx, sub, []string{e})
+	}
+}
+
+// subscribe subscribes to the given events in the background until the context is cancelled
+func (m *Manager) subscribe(ctx context.Context, sub *subscription, events []string) {
+	m.log(LogLevelDebug, "Subscribing to %v", events)
+	go func() {
+		err := sub.broker.Subscribe(ctx, events, sub.messages)
+		if err != nil && ctx.Err() == nil {
+			m.log(LogLevelError, "failed to subscribe to broker: %s", err)
+		}
+	}()
+}
+
+// subscribedTo returns whether the given topics are exactly the given events
+func subscribedTo(topics map[string]context.CancelFunc, events []string) bool {
+	if len(topics) != len(events) {
+		return false
+	}
+
+	for _, e := range events {
+		if _, ok := topics[e]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// closeSpill syncs and closes the spill buffer of the current subscription, if any
+func (m *Manager) closeSpill() error {
+	m.subMu.Lock()
+	sub := m.sub
+	m.subMu.Unlock()
+
+	if sub == nil || sub.queue.spill == nil {
+		return nil
+	}
+	return sub.queue.spill.close()
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spec-tacles/go/broker"
+	"github.com/spec-tacles/go/types"
+)
+
+// fakeBroker stands in for a broker, recording publications and handing its subscriptions to the
+// test
+type fakeBroker struct {
+	published    chan fakeMessage
+	subscribed   chan []string
+	unsubscribed chan []string
+	messages     chan chan<- broker.Message
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		published:    make(chan fakeMessage, 16),
+		subscribed:   make(chan []string, 16),
+		unsubscribed: make(chan []string, 16),
+		messages:     make(chan chan<- broker.Message, 16),
+	}
+}
+
+func (b *fakeBroker) Publish(ctx context.Context, event string, data interface{}) error {
+	b.published <- fakeMessage{event: event, body: data}
+	return nil
+}
+
+func (b *fakeBroker) Subscribe(ctx context.Context, events []string, messages chan<- broker.Message) error {
+	b.subscribed <- events
+	b.messages <- messages
+	<-ctx.Done()
+	b.unsubscribed <- events
+	return ctx.Err()
+}
+
+// receiveEvents receives n sets of events from the given channel, returning the events sorted
+func receiveEvents(t *testing.T, ch chan []string, n int) (events []string) {
+	t.Helper()
+
+	for range n {
+		select {
+		case e := <-ch:
+			events = append(events, e...)
+		case <-time.After(time.Second):
+			t.Fatalf("only received %v", events)
+		}
+	}
+
+	slices.Sort(events)
+	return
+}
+
+// fakeMessage is a message from a fakeBroker, which is closed once acknowledged
+type fakeMessage struct {
+	event string
+	body  interface{}
+	acked chan struct{}
+}
+
+func newFakeMessage(event string, body string) *fakeMessage {
+	return &fakeMessage{event: event, body: []byte(body), acked: make(chan struct{})}
+}
+
+func (m *fakeMessage) Event() string                            { return m.event }
+func (m *fakeMessage) Body() interface{}                        { return m.body }
+func (m *fakeMessage) Reply(context.Context, interface{}) error { return broker.ErrCannotReply }
+func (m *fakeMessage) Ack(context.Context) error                { close(m.acked); return nil }
+
+func TestConnectBrokerCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewManager(&ManagerOptions{
+		ShardCount:   3,
+		ShardOptions: &ShardOptions{Identify: &types.Identify{}},
+	})
+
+	b := newFakeBroker()
+	m.ConnectBroker(ctx, b, nil)
+	m.setShardIDs([]int{0})
+
+	if events, want := receiveEvents(t, b.subscribed, 2), []string{"0", "SEND"}; !slices.Equal(events, want) {
+		t.Fatalf("subscribed to %v, want %v", events, want)
+	}
+	messages := <-b.messages
+
+	tests := []struct {
+		name    string
+		event   string
+		body    string
+		publish []string
+	}{
+		{"shard", "SEND", `{"shard_id":1,"packet":{"op":3,"d":null}}`, []string{"1"}},
+		{"guild", "SEND", `{"guild_id":"8388608","packet":{"op":3,"d":null}}`, []string{"2"}},
+		{"broadcast", "SEND", `{"broadcast":true,"packet":{"op":3,"d":null}}`, []string{"0", "1", "2"}},
+		{"unknown shard", "SEND", `{"shard_id":3,"packet":{"op":3,"d":null}}`, nil},
+		{"no packet", "SEND", `{"shard_id":1}`, nil},
+		{"invalid", "SEND", `{`, nil},
+		{"not spawned", "0", `{"op":3,"d":null}`, nil},
+		{"not a shard", "foo", `{"op":3,"d":null}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := newFakeMessage(tt.event, tt.body)
+			messages <- msg
+
+			select {
+			case <-msg.acked:
+			case <-time.After(time.Second):
+				t.Fatal("message was not acknowledged")
+			}
+
+			var events []string
+			for len(b.published) != 0 {
+				p := <-b.published
+				events = append(events, p.event)
+
+				sp := &UnknownSendPacket{}
+				if err := json.Unmarshal(p.body.([]byte), sp); err != nil {
+					t.Fatalf("republished invalid packet: %s", err)
+				}
+				if sp.Packet == nil || sp.Packet.Op != types.GatewayOpStatusUpdate {
+					t.Errorf("republished packet %+v", sp.Packet)
+				}
+			}
+
+			if !slices.Equal(events, tt.publish) {
+				t.Errorf("republished to %v, want %v", events, tt.publish)
+			}
+		})
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewManager(&ManagerOptions{
+		ShardCount:   4,
+		ShardOptions: &ShardOptions{Identify: &types.Identify{}},
+		LogLevel:     LogLevelSuppress,
+	})
+
+	b := newFakeBroker()
+	m.ConnectBroker(ctx, b, nil)
+	m.setShardIDs([]int{0, 1})
+
+	if events, want := receiveEvents(t, b.subscribed, 3), []string{"0", "1", "SEND"}; !slices.Equal(events, want) {
+		t.Fatalf("subscribed to %v, want %v", events, want)
+	}
+
+	// only the topics of shards that were added or removed are subscribed to or cancelled
+	m.setShardIDs([]int{1, 2, 3})
+
+	if events, want := receiveEvents(t, b.subscribed, 2), []string{"2", "3"}; !slices.Equal(events, want) {
+		t.Errorf("subscribed to %v, want %v", events, want)
+	}
+	if events, want := receiveEvents(t, b.unsubscribed, 1), []string{"0"}; !slices.Equal(events, want) {
+		t.Errorf("unsubscribed from %v, want %v", events, want)
+	}
+
+	// every topic is cancelled separately once the manager's context is
+	cancel()
+	if events, want := receiveEvents(t, b.unsubscribed, 4), []string{"1", "2", "3", "SEND"}; !slices.Equal(events, want) {
+		t.Errorf("unsubscribed from %v, want %v", events, want)
+	}
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// shardRun tracks the current run of a shard spawned by the manager
+type shardRun struct {
+	cancel  context.CancelFunc
+	restart bool
+}
+
+// startRun records that the given shard of a set is running and can be stopped with cancel
+func (m *Manager) startRun(set *shardSet, id int, cancel context.CancelFunc) {
+	m.shardsMu.Lock()
+	defer m.shardsMu.Unlock()
+
+	set.runs[id] = &shardRun{cancel: cancel}
+}
+
+// finishRun records that the given shard of a set has stopped and returns whether it should
+// restart
+func (m *Manager) finishRun(set *shardSet, id int) (restart bool) {
+	m.shardsMu.Lock()
+	defer m.shardsMu.Unlock()
+
+	run := set.runs[id]
+	if run == nil {
+		return
+	}
+
+	restart = run.restart
+	run.cancel = nil
+	run.restart = false
+	return
+}
+
+// Shard returns the shard with the given ID, or nil if it has not been spawned
+func (m *Manager) Shard(id int) *Shard {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	return m.Shards[id]
+}
+
+// ShardStatuses returns the state of every shard spawned by this manager
+func (m *Manager) ShardStatuses() map[int]ShardState {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	statuses := make(map[int]ShardState, len(m.Shards))
+	for id, s := range m.Shards {
+		statuses[id] = s.Status()
+	}
+	return statuses
+}
+
+// Health returns the number of healthy, dead and total shards spawned by this manager. Dead shards
+// whose leases were released by the shard coordinator still count as dead.
+func (m *Manager) Health() (healthy, dead, total int) {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	for _, s := range m.Shards {
+		switch {
+		case s.Healthy():
+			healthy++
+		case s.Status() == ShardStateDead:
+			dead++
+		}
+	}
+
+	total = len(m.Shards)
+	if m.set != nil {
+		dead += len(m.set.dead)
+		total += len(m.set.dead)
+	}
+	return
+}
+
+// RestartShard closes the given shard's connection without invalidating its session and opens it
+// again. Dead shards are spawned again.
+func (m *Manager) RestartShard(id int) error {
+	m.shardsMu.Lock()
+	defer m.shardsMu.Unlock()
+
+	run, ok := m.runs[id]
+	if !ok {
+		return ErrShardNotFound
+	}
+
+	if run.restart {
+		return nil
+	}
+
+	if run.cancel != nil {
+		m.log(LogLevelInfo, "Restart requested for shard %d", id)
+		run.restart = true
+		run.cancel()
+		return nil
+	}
+
+	if m.set == nil || m.set.ctx.Err() != nil {
+		return ErrManagerStopped
+	}
+
+	if !m.runShard(m.set, id) {
+		return ErrManagerStopped
+	}
+
+	m.log(LogLevelInfo, "Respawning dead shard %d", id)
+	run.restart = true
+	return nil
+}
+
+// Stop closes all shards without invalidating their sessions, causing Start to return
+func (m *Manager) Stop() {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	if m.cancel != nil {
+		m.log(LogLevelInfo, "Stopping all shards")
+		m.cancel()
+	}
+}
+
+// UpdatePresence updates the presence of every ready shard. Every shard spawned by this manager
+// identifies with the latest presence, including shards that are already running.
+func (m *Manager) UpdatePresence(presence *types.StatusUpdate) error {
+	m.presence.Store(presence)
+
+	m.shardsMu.RLock()
+	shards := maps.Clone(m.Shards)
+	m.shardsMu.RUnlock()
+
+	var errs []error
+	for id, s := range shards {
+		if s.Status() != ShardStateReady {
+			continue
+		}
+
+		if err := s.UpdatePresence(presence); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// coordinate runs the shards of a set that this manager holds leases on. It leases its own shards
+// first and, once leases held by processes that stopped before it started have had time to
+// expire, takes over any shard whose lease isn't being renewed. Shards whose leases are lost are
+// stopped, and the leases of shards that die are released for other processes to take over. When
+// the set is stopped, its leases are released once its shards have stored their sessions.
+func (m *Manager) coordinate(set *shardSet, own []int) {
+	defer m.untrack()
+
+	ttl := m.opts.ShardCoordinator.TTL()
+	takeoverAt := time.Now().Add(ttl)
+	leases := make(map[int]time.Time)
+
+	all := make([]int, set.count)
+	for id := range all {
+		all[id] = id
+	}
+
+	t := time.NewTicker(ttl / 3)
+	defer t.Stop()
+
+	for {
+		changed := m.renewLeases(set, leases)
+		if m.acquireLeases(set, leases, own, false) {
+			changed = true
+		}
+		if time.Now().After(takeoverAt) && m.acquireLeases(set, leases, all, true) {
+			changed = true
+		}
+
+		if changed {
+			ids := make([]int, 0, len(leases))
+			for id := range leases {
+				ids = append(ids, id)
+			}
+			slices.Sort(ids)
+
+			m.log(LogLevelInfo, "Running %d shard(s) out of %d total", len(ids), set.count)
+			m.setShardIDs(ids)
+		}
+
+		select {
+		case <-set.ctx.Done():
+			set.wg.Wait()
+			m.releaseLeases(leases)
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// acquireLeases leases and runs any of the given shards that aren't leased by another process and
+// haven't died in this one. Shards that were stopped aren't leased again until they have finished
+// storing their sessions.
+func (m *Manager) acquireLeases(set *shardSet, leases map[int]time.Time, ids []int, takeover bool) (changed bool) {
+	for _, id := range ids {
+		if _, ok := leases[id]; ok {
+			continue
+		}
+		if m.shardReleased(set, id) || m.shardRunning(set, id) {
+			continue
+		}
+
+		ok, err := m.opts.ShardCoordinator.Acquire(set.ctx, id)
+		if err != nil {
+			if set.ctx.Err() == nil {
+				m.log(LogLevelWarn, "Unable to acquire lease on shard %d: %s", id, err)
+			}
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if takeover {
+			m.log(LogLevelInfo, "Taking over shard %d", id)
+		}
+
+		m.shardsMu.Lock()
+		m.runShard(set, id)
+		m.shardsMu.Unlock()
+
+		leases[id] = time.Now()
+		changed = true
+	}
+	return
+}
+
+// renewLeases renews the leases on the shards of a set, stopping shards whose leases have been
+// lost or couldn't be renewed before they expired. The leases of dead shards are released instead
+// and the shards are added to the set's dead shards.
+func (m *Manager) renewLeases(set *shardSet, leases map[int]time.Time) (changed bool) {
+	ttl := m.opts.ShardCoordinator.TTL()
+	for id, renewed := range leases {
+		if m.shardDead(set, id) {
+			m.log(LogLevelError, "Shard %d is dead, releasing its lease", id)
+			if err := m.opts.ShardCoordinator.Release(set.ctx, id); err != nil && set.ctx.Err() == nil {
+				m.log(LogLevelWarn, "Unable to release lease on shard %d: %s", id, err)
+			}
+
+			m.stopShard(set, id)
+			m.shardsMu.Lock()
+			set.dead[id] = struct{}{}
+			m.shardsMu.Unlock()
+
+			delete(leases, id)
+			changed = true
+			continue
+		}
+
+		ok, err := m.opts.ShardCoordinator.Renew(set.ctx, id)
+		switch {
+		case set.ctx.Err() != nil:
+			return
+		case err != nil && time.Since(renewed) < ttl:
+			m.log(LogLevelWarn, "Unable to renew lease on shard %d: %s", id, err)
+			continue
+		case err != nil:
+			m.log(LogLevelError, "Lease on shard %d expired before it could be renewed, stopping it: %s", id, err)
+		case !ok:
+			m.log(LogLevelError, "Lease on shard %d was lost, stopping it", id)
+		default:
+			leases[id] = time.Now()
+			continue
+		}
+
+		m.stopShard(set, id)
+		delete(leases, id)
+		changed = true
+	}
+	return
+}
+
+// shardDead returns whether a shard of a set has died
+func (m *Manager) shardDead(set *shardSet, id int) bool {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	s := set.shards[id]
+	return s != nil && s.Status() == ShardStateDead
+}
+
+// shardReleased returns whether a shard of a set died and was released
+func (m *Manager) shardReleased(set *shardSet, id int) bool {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	_, ok := set.dead[id]
+	return ok
+}
+
+// shardRunning returns whether a shard of a set is running or still stopping
+func (m *Manager) shardRunning(set *shardSet, id int) bool {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	_, ok := set.running[id]
+	return ok
+}
+
+// stopShard closes a shard of a set without invalidating its session and forgets it, so that its
+// packets are no longer forwarded
+func (m *Manager) stopShard(set *shardSet, id int) {
+	m.shardsMu.Lock()
+	defer m.shardsMu.Unlock()
+
+	if run := set.runs[id]; run != nil && run.cancel != nil {
+		run.cancel()
+	}
+
+	delete(set.shards, id)
+	delete(set.runs, id)
+}
+
+// releaseLeases releases the given leases so that other processes can take over their shards
+// without waiting for them to expire
+func (m *Manager) releaseLeases(leases map[int]time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	for id := range leases {
+		if err := m.opts.ShardCoordinator.Release(ctx, id); err != nil {
+			m.log(LogLevelWarn, "Unable to release lease on shard %d: %s", id, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// fakeCoordinator records the leases requested of it, granting every one
+type fakeCoordinator struct {
+	mu                          sync.Mutex
+	acquired, renewed, released []int
+}
+
+func (c *fakeCoordinator) Acquire(ctx context.Context, shardID int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.acquired = append(c.acquired, shardID)
+	return true, nil
+}
+
+func (c *fakeCoordinator) Renew(ctx context.Context, shardID int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.renewed = append(c.renewed, shardID)
+	return true, nil
+}
+
+func (c *fakeCoordinator) Release(ctx context.Context, shardID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.released = append(c.released, shardID)
+	return nil
+}
+
+func (c *fakeCoordinator) TTL() time.Duration {
+	return DefaultLeaseTTL
+}
+
+func TestRenewLeasesDead(t *testing.T) {
+	c := &fakeCoordinator{}
+	m := NewManager(&ManagerOptions{
+		ShardOptions:     &ShardOptions{Identify: &types.Identify{}},
+		ShardCoordinator: c,
+		LogLevel:         LogLevelSuppress,
+	})
+
+	shards := make(map[int]*Shard)
+	for id, state := range []ShardState{ShardStateReady, ShardStateDead, ShardStateReconnecting} {
+		shards[id] = NewShard(&ShardOptions{Identify: &types.Identify{Shard: []int{id, 3}}})
+		shards[id].state.Store(int32(state))
+	}
+
+	set := &shardSet{
+		count:   3,
+		shards:  shards,
+		runs:    make(map[int]*shardRun),
+		dead:    make(map[int]struct{}),
+		running: make(map[int]struct{}),
+		ctx:     context.Background(),
+	}
+	m.set, m.Shards = set, shards
+	leases := map[int]time.Time{0: time.Now(), 1: time.Now(), 2: time.Now()}
+
+	if !m.renewLeases(set, leases) {
+		t.Error("leases weren't changed by a dead shard")
+	}
+
+	slices.Sort(c.renewed)
+	if !slices.Equal(c.renewed, []int{0, 2}) || !slices.Equal(c.released, []int{1}) {
+		t.Errorf("renewed %v and released %v, want [0 2] and [1]", c.renewed, c.released)
+	}
+
+	if _, ok := leases[1]; ok || len(leases) != 2 {
+		t.Errorf("leases %v still include the dead shard", leases)
+	}
+	if _, ok := set.shards[1]; ok {
+		t.Error("dead shard wasn't forgotten")
+	}
+
+	// the released shard still counts as dead
+	if _, dead, total := m.Health(); dead != 1 || total != 3 {
+		t.Errorf("health counts %d dead shard(s) out of %d, want 1 out of 3", dead, total)
+	}
+
+	// the dead shard is left for other processes to take over
+	if m.acquireLeases(set, leases, []int{0, 1, 2}, false) || len(c.acquired) != 0 {
+		t.Errorf("acquired %v after the dead shard's lease was released", c.acquired)
+	}
+
+	c.renewed = nil
+	if m.renewLeases(set, leases) || len(c.renewed) != 2 || len(c.released) != 1 {
+		t.Errorf("renewed %v and released %v once the dead shard was released", c.renewed, c.released)
+	}
+}
+
+func TestAcquireLeasesStopping(t *testing.T) {
+	c := &fakeCoordinator{}
+	m := NewManager(&ManagerOptions{
+		ShardOptions:     &ShardOptions{Identify: &types.Identify{}},
+		ShardCoordinator: c,
+		LogLevel:         LogLevelSuppress,
+	})
+
+	set := &shardSet{
+		count:   1,
+		shards:  make(map[int]*Shard),
+		runs:    make(map[int]*shardRun),
+		dead:    make(map[int]struct{}),
+		running: map[int]struct{}{0: {}},
+		ctx:     context.Background(),
+	}
+
+	// a shard that was stopped isn't leased again until it has stored its session
+	if m.acquireLeases(set, make(map[int]time.Time), []int{0}, true) || len(c.acquired) != 0 {
+		t.Errorf("acquired %v while the shard was still stopping", c.acquired)
+	}
+}
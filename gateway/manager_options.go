@@ -2,6 +2,8 @@ package gateway
 
 import (
 	"log"
+	"os"
+	"runtime"
 	"time"
 
 	"github.com/spec-tacles/go/types"
@@ -16,28 +18,109 @@ type ShardLimiter interface {
 type ManagerOptions struct {
 	ShardOptions *ShardOptions
 	REST         REST
+
+	// ShardLimiter, if set, is locked by every shard before identifying. By default, shards
+	// identify in parallel buckets according to the session start limit's max concurrency.
 	ShardLimiter Limiter
 
-	ShardCount  int
+	// SessionStartReserve is the number of daily session starts left unused: identifies are delayed
+	// until the session start limit resets once no more than this many remain
+	SessionStartReserve int
+
+	ShardCount int
+
+	// ShardIDs are the IDs of the shards to start. If empty, shards are distributed between
+	// ServerCount processes and this process starts those belonging to ServerIndex.
+	ShardIDs    []int
 	ServerIndex int
 	ServerCount int
 
-	OnPacket func(int, *types.ReceivePacket)
+	// ShardCoordinator, if set, leases shards so that each is run by one process at a time. The
+	// shards given by ShardIDs or ServerIndex are leased first; shards of other processes are taken
+	// over once their leases expire and resume from the ShardStore, which must be shared.
+	ShardCoordinator ShardCoordinator
+
+	// ReshardInterval, if set, is the interval at which Discord's recommended shard count is
+	// checked, resharding when it exceeds ShardCount. Shards are always resharded when Discord
+	// closes them because more shards are required, unless ShardIDs or a ShardCoordinator are set.
+	ReshardInterval time.Duration
+
+	// ShardRouter determines the shards that SEND packets from the broker are sent to; defaults
+	// to DefaultShardRouter
+	ShardRouter ShardRouter
+
+	// Envelope is the format events are published to the broker in: EnvelopeNone publishes only
+	// the event data, while EnvelopeJSON and EnvelopeBinary wrap it in an Envelope
+	Envelope string
+	// InstanceID identifies this gateway in envelopes; defaults to the hostname
+	InstanceID string
+
+	// PartitionKey, if set, is the field that events are partitioned by so that events with the
+	// same key are consumed in order: PartitionKeyGuild or PartitionKeyChannel. Brokers that
+	// implement KeyedPublisher receive the key; otherwise events are published under
+	// PartitionTopic, split between Partitions topics (defaults to 1), and the key is ignored
+	// unless there's more than one.
+	PartitionKey string
+	Partitions   int
+
+	// PublishWorkers is the number of goroutines publishing events to the broker; defaults to the
+	// number of CPUs. Each has a queue of up to PublishQueueSize events (defaults to 1000); when
+	// it's full, PublishOverflow determines whether shards block (OverflowBlock, the default),
+	// the oldest queued event is dropped (OverflowDropOldest) or the event is spilled
+	// (OverflowSpill).
+	PublishWorkers   int
+	PublishQueueSize int
+	PublishOverflow  string
+
+	// SpillDir, if set, is the directory that events which can't be published are written to
+	// until the broker recovers, up to SpillMaxSize bytes (defaults to 1 GiB)
+	SpillDir     string
+	SpillMaxSize int64
+
+	OnPacket      func(int, *types.ReceivePacket)
+	OnStateChange func(id int, old, new ShardState)
 
 	Logger   *log.Logger
 	LogLevel int
 }
 
 func (opts *ManagerOptions) init() {
-	if opts.ShardLimiter == nil {
-		// this is supposed to be 5s, but 5s causes every other session to be invalidated
-		opts.ShardLimiter = NewDefaultLimiter(1, 5250*time.Millisecond)
-	}
-
 	if opts.ServerCount == 0 {
 		opts.ServerCount = 1
 	}
 
+	if opts.ShardRouter == nil {
+		opts.ShardRouter = DefaultShardRouter{}
+	}
+
+	if opts.Envelope == "" {
+		opts.Envelope = EnvelopeNone
+	}
+
+	if opts.Partitions == 0 {
+		opts.Partitions = 1
+	}
+
+	if opts.PublishWorkers == 0 {
+		opts.PublishWorkers = runtime.NumCPU()
+	}
+
+	if opts.PublishQueueSize == 0 {
+		opts.PublishQueueSize = 1000
+	}
+
+	if opts.PublishOverflow == "" {
+		opts.PublishOverflow = OverflowBlock
+	}
+
+	if opts.SpillMaxSize == 0 {
+		opts.SpillMaxSize = 1 << 30
+	}
+
+	if opts.InstanceID == "" {
+		opts.InstanceID, _ = os.Hostname()
+	}
+
 	if opts.Logger == nil {
 		opts.Logger = DefaultLogger
 	}
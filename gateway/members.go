@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// memberRequestTimeout is how long a guild members request waits for its chunks before it's
+// forgotten
+const memberRequestTimeout = 5 * time.Minute
+
+// GuildMembersChunk represents a GUILD_MEMBERS_CHUNK dispatch
+type GuildMembersChunk struct {
+	GuildID    string            `json:"guild_id"`
+	Members    []json.RawMessage `json:"members"`
+	ChunkIndex int               `json:"chunk_index"`
+	ChunkCount int               `json:"chunk_count"`
+	NotFound   []json.RawMessage `json:"not_found,omitempty"`
+	Presences  []json.RawMessage `json:"presences,omitempty"`
+	Nonce      string            `json:"nonce,omitempty"`
+}
+
+// GuildMembersResponse represents every chunk sent in response to a guild members request
+type GuildMembersResponse struct {
+	GuildID   string            `json:"guild_id"`
+	Nonce     string            `json:"nonce"`
+	Members   []json.RawMessage `json:"members"`
+	NotFound  []json.RawMessage `json:"not_found"`
+	Presences []json.RawMessage `json:"presences"`
+}
+
+// memberRequest is a guild members request awaiting its chunks
+type memberRequest struct {
+	replyTo   string
+	aggregate bool
+	expires   time.Time
+
+	chunks map[int]*GuildMembersChunk
+	next   int
+}
+
+// memberRequests correlates GUILD_MEMBERS_CHUNK dispatches with the requests that caused them
+// using their nonce
+type memberRequests struct {
+	mu      sync.Mutex
+	pending map[string]*memberRequest
+}
+
+// track waits for the chunks sent in response to a guild members request. It returns the packet
+// to send, which is a copy with a new nonce if the request didn't have one, and false if the
+// packet isn't a guild members request.
+func (r *memberRequests) track(p *types.SendPacket, replyTo string, aggregate bool) (*types.SendPacket, bool) {
+	data, ok := p.Data.(map[string]interface{})
+	if p.Op != types.GatewayOpRequestGuildMembers || !ok {
+		return p, false
+	}
+
+	nonce, _ := data["nonce"].(string)
+	if nonce == "" {
+		nonce = newNonce()
+		data = maps.Clone(data)
+		data["nonce"] = nonce
+		p = &types.SendPacket{Op: p.Op, Data: data}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.pending == nil {
+		r.pending = make(map[string]*memberRequest)
+	}
+	r.prune(now)
+
+	r.pending[nonce] = &memberRequest{
+		replyTo:   replyTo,
+		aggregate: aggregate,
+		expires:   now.Add(memberRequestTimeout),
+		chunks:    make(map[int]*GuildMembersChunk),
+	}
+	return p, true
+}
+
+// prune forgets the requests that have expired; the lock must be held
+func (r *memberRequests) prune(now time.Time) {
+	for n, req := range r.pending {
+		if now.After(req.expires) {
+			delete(r.pending, n)
+		}
+	}
+}
+
+// handle adds a chunk to its request. It returns the topic to reply to and the payloads to
+// publish there: chunks in order as they become available, or the complete response once every
+// chunk has been received.
+func (r *memberRequests) handle(data json.RawMessage) (replyTo string, payloads [][]byte, err error) {
+	if !bytes.Contains(data, []byte(`"nonce"`)) {
+		return
+	}
+
+	chunk := &GuildMembersChunk{}
+	if err = json.Unmarshal(data, chunk); err != nil || chunk.Nonce == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(time.Now())
+	req, ok := r.pending[chunk.Nonce]
+	if !ok {
+		return
+	}
+
+	req.chunks[chunk.ChunkIndex] = chunk
+	if req.aggregate {
+		if len(req.chunks) < chunk.ChunkCount {
+			return
+		}
+		delete(r.pending, chunk.Nonce)
+
+		res := &GuildMembersResponse{
+			GuildID:   chunk.GuildID,
+			Nonce:     chunk.Nonce,
+			Members:   []json.RawMessage{},
+			NotFound:  []json.RawMessage{},
+			Presences: []json.RawMessage{},
+		}
+		for i := 0; i < chunk.ChunkCount; i++ {
+			c, ok := req.chunks[i]
+			if !ok {
+				continue
+			}
+
+			res.Members = append(res.Members, c.Members...)
+			res.NotFound = append(res.NotFound, c.NotFound...)
+			res.Presences = append(res.Presences, c.Presences...)
+		}
+
+		d, err := json.Marshal(res)
+		if err != nil {
+			return "", nil, err
+		}
+		return req.replyTo, [][]byte{d}, nil
+	}
+
+	for c, ok := req.chunks[req.next]; ok; c, ok = req.chunks[req.next] {
+		d, err := json.Marshal(c)
+		if err != nil {
+			return "", nil, err
+		}
+
+		payloads = append(payloads, d)
+		delete(req.chunks, req.next)
+		req.next++
+	}
+
+	if req.next >= chunk.ChunkCount {
+		delete(r.pending, chunk.Nonce)
+	}
+	return req.replyTo, payloads, nil
+}
+
+// newNonce returns a random nonce of the maximum length Discord accepts
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+func TestMemberRequestsTrack(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  *types.SendPacket
+		tracked bool
+		nonce   string
+	}{
+		{"nonce", &types.SendPacket{Op: types.GatewayOpRequestGuildMembers, Data: map[string]interface{}{"guild_id": "1", "nonce": "abc"}}, true, "abc"},
+		{"no nonce", &types.SendPacket{Op: types.GatewayOpRequestGuildMembers, Data: map[string]interface{}{"guild_id": "1"}}, true, ""},
+		{"not a request", &types.SendPacket{Op: types.GatewayOpStatusUpdate, Data: map[string]interface{}{"status": "idle"}}, false, ""},
+		{"no data", &types.SendPacket{Op: types.GatewayOpRequestGuildMembers}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &memberRequests{}
+			original := fmt.Sprint(tt.packet.Data)
+
+			p, ok := r.track(tt.packet, "REPLY", false)
+			if ok != tt.tracked {
+				t.Fatalf("tracked = %t, want %t", ok, tt.tracked)
+			}
+
+			if got := fmt.Sprint(tt.packet.Data); got != original {
+				t.Errorf("packet data was changed to %s", got)
+			}
+
+			if !ok {
+				if p != tt.packet || len(r.pending) != 0 {
+					t.Errorf("packet %+v was tracked", p)
+				}
+				return
+			}
+
+			nonce, _ := p.Data.(map[string]interface{})["nonce"].(string)
+			if nonce == "" || (tt.nonce != "" && nonce != tt.nonce) {
+				t.Errorf("sent with nonce %q, want %q", nonce, tt.nonce)
+			}
+
+			if req := r.pending[nonce]; req == nil || req.replyTo != "REPLY" {
+				t.Errorf("request with nonce %q wasn't tracked", nonce)
+			}
+		})
+	}
+}
+
+// memberChunk returns a guild members chunk with the given nonce and index, containing a member
+// with the index as its ID
+func memberChunk(nonce string, index, count int) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"guild_id":"1","members":[{"id":"%d"}],"chunk_index":%d,"chunk_count":%d,"nonce":"%s"}`, index, index, count, nonce))
+}
+
+func TestMemberRequestsHandle(t *testing.T) {
+	tests := []struct {
+		name      string
+		aggregate bool
+		order     []int
+
+		// published holds the chunk indexes or member IDs published after each chunk is handled
+		published [][]int
+	}{
+		{"in order", false, []int{0, 1, 2}, [][]int{{0}, {1}, {2}}},
+		{"out of order", false, []int{2, 0, 1}, [][]int{nil, {0}, {1, 2}}},
+		{"reversed", false, []int{2, 1, 0}, [][]int{nil, nil, {0, 1, 2}}},
+		{"single chunk", false, []int{0}, [][]int{{0}}},
+		{"aggregate", true, []int{0, 1, 2}, [][]int{nil, nil, {0, 1, 2}}},
+		{"aggregate out of order", true, []int{1, 2, 0}, [][]int{nil, nil, {0, 1, 2}}},
+		{"aggregate single chunk", true, []int{0}, [][]int{{0}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &memberRequests{}
+			packet := &types.SendPacket{Op: types.GatewayOpRequestGuildMembers, Data: map[string]interface{}{"nonce": "n"}}
+			if _, ok := r.track(packet, "REPLY", tt.aggregate); !ok {
+				t.Fatal("request wasn't tracked")
+			}
+
+			for i, index := range tt.order {
+				replyTo, payloads, err := r.handle(memberChunk("n", index, len(tt.order)))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(payloads) != 0 && replyTo != "REPLY" {
+					t.Errorf("replied to %q, want REPLY", replyTo)
+				}
+
+				if got := publishedMembers(t, payloads, tt.aggregate); !slices.Equal(got, tt.published[i]) {
+					t.Errorf("chunk %d published %v, want %v", index, got, tt.published[i])
+				}
+			}
+
+			if len(r.pending) != 0 {
+				t.Error("request wasn't forgotten once every chunk was received")
+			}
+		})
+	}
+}
+
+// publishedMembers returns the chunk indexes of published chunks, or the member IDs of a
+// published aggregate response
+func publishedMembers(t *testing.T, payloads [][]byte, aggregate bool) (got []int) {
+	t.Helper()
+
+	for _, d := range payloads {
+		if !aggregate {
+			c := &GuildMembersChunk{}
+			if err := json.Unmarshal(d, c); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c.ChunkIndex)
+			continue
+		}
+
+		res := &struct {
+			Members []struct {
+				ID int `json:"id,string"`
+			} `json:"members"`
+		}{}
+		if err := json.Unmarshal(d, res); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range res.Members {
+			got = append(got, m.ID)
+		}
+	}
+	return
+}
+
+func TestMemberRequestsExpiry(t *testing.T) {
+	r := &memberRequests{}
+	for _, nonce := range []string{"expired", "pending"} {
+		packet := &types.SendPacket{Op: types.GatewayOpRequestGuildMembers, Data: map[string]interface{}{"nonce": nonce}}
+		r.track(packet, "REPLY", false)
+	}
+	r.pending["expired"].expires = time.Now().Add(-time.Second)
+
+	// expired requests are forgotten by the next chunk, even one for another request
+	if _, payloads, _ := r.handle(memberChunk("pending", 1, 2)); len(payloads) != 0 {
+		t.Errorf("published %d chunk(s) before the first", len(payloads))
+	}
+	if _, ok := r.pending["expired"]; ok {
+		t.Error("expired request wasn't forgotten")
+	}
+
+	if _, payloads, _ := r.handle(memberChunk("expired", 0, 1)); len(payloads) != 0 {
+		t.Errorf("published %d chunk(s) of an expired request", len(payloads))
+	}
+
+	if _, payloads, _ := r.handle(memberChunk("unknown", 0, 1)); len(payloads) != 0 {
+		t.Errorf("published %d chunk(s) of an unknown request", len(payloads))
+	}
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/spec-tacles/go/broker"
+)
+
+// Partition keys for published events
+const (
+	PartitionKeyGuild   = "guild_id"
+	PartitionKeyChannel = "channel_id"
+)
+
+// KeyedPublisher is implemented by brokers that can partition published events by key, such that
+// events with the same key are consumed in order
+type KeyedPublisher interface {
+	PublishKeyed(ctx context.Context, event, key string, data interface{}) error
+}
+
+// Partition returns the partition of n that events with the given key are published to. Events
+// without a key are published to the first partition.
+func Partition(key string, n int) int {
+	if key == "" {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// PartitionTopic returns the event that events with the given key are published under by brokers
+// that can't partition by key. Events aren't renamed if there's only one partition.
+func PartitionTopic(event, key string, n int) string {
+	if n <= 1 {
+		return event
+	}
+	return event + "." + strconv.Itoa(Partition(key, n))
+}
+
+// partitionKeys holds the fields events can be partitioned by
+type partitionKeys struct {
+	GuildID   string `json:"guild_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+// partitionKey returns the value of the given field in the event data, or an empty string if it
+// doesn't have one
+func partitionKey(data json.RawMessage, field string) string {
+	keys := partitionKeys{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return ""
+	}
+
+	if field == PartitionKeyChannel {
+		return keys.ChannelID
+	}
+	return keys.GuildID
+}
+
+// brokerPartitionKey returns the configured partition key, unless the broker can't publish events
+// by key and there's only one partition for it to publish them under instead
+func (m *Manager) brokerPartitionKey(b broker.Broker) string {
+	if m.opts.PartitionKey == "" {
+		return ""
+	}
+
+	if _, ok := b.(KeyedPublisher); !ok && m.opts.Partitions <= 1 {
+		m.log(LogLevelError, "ignoring partition key %q: the broker can't publish events by key, so more than one partition is required", m.opts.PartitionKey)
+		return ""
+	}
+	return m.opts.PartitionKey
+}
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spec-tacles/go/broker"
+	"github.com/spec-tacles/go/types"
+)
+
+func TestPartitionTopic(t *testing.T) {
+	tests := []struct {
+		key  string
+		n    int
+		want string
+	}{
+		{"", 0, "MESSAGE_UPDATE"},
+		{"81384788765712384", 0, "MESSAGE_UPDATE"},
+		{"81384788765712384", 1, "MESSAGE_UPDATE"},
+		{"", 4, "MESSAGE_UPDATE.0"},
+		{"81384788765712384", 4, "MESSAGE_UPDATE.3"},
+		{"41771983423143936", 4, "MESSAGE_UPDATE.2"},
+	}
+
+	for _, tt := range tests {
+		if got := PartitionTopic("MESSAGE_UPDATE", tt.key, tt.n); got != tt.want {
+			t.Errorf("PartitionTopic(%q, %d) = %q, want %q", tt.key, tt.n, got, tt.want)
+		}
+	}
+}
+
+// keyedBroker is a fakeBroker that publishes events by key
+type keyedBroker struct {
+	*fakeBroker
+	keys chan string
+}
+
+func (b *keyedBroker) PublishKeyed(ctx context.Context, event, key string, data interface{}) error {
+	b.keys <- key
+	return b.Publish(ctx, event, data)
+}
+
+func TestPartitionedPublish(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyed      bool
+		partitions int
+		event      string
+		key        string
+	}{
+		{"one partition", false, 1, "MESSAGE_CREATE", ""},
+		{"partitions", false, 4, "MESSAGE_CREATE.3", ""},
+		{"keyed", true, 1, "MESSAGE_CREATE", "81384788765712384"},
+		{"keyed partitions", true, 4, "MESSAGE_CREATE", "81384788765712384"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(&ManagerOptions{
+				ShardOptions: &ShardOptions{Identify: &types.Identify{}},
+				PartitionKey: PartitionKeyGuild,
+				Partitions:   tt.partitions,
+				LogLevel:     LogLevelSuppress,
+			})
+
+			fb := newFakeBroker()
+			kb := &keyedBroker{fb, make(chan string, 1)}
+			var b broker.Broker = fb
+			if tt.keyed {
+				b = kb
+			}
+			q := newPublishQueue(context.Background(), m, b)
+
+			m.enqueue(q, 0, &types.ReceivePacket{
+				Op:    types.GatewayOpDispatch,
+				Event: "MESSAGE_CREATE",
+				Data:  []byte(`{"guild_id":"81384788765712384"}`),
+			}, []byte("{}"))
+
+			if p := <-fb.published; p.event != tt.event {
+				t.Errorf("published under %q, want %q", p.event, tt.event)
+			}
+
+			if tt.keyed {
+				if key := <-kb.keys; key != tt.key {
+					t.Errorf("published with key %q, want %q", key, tt.key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spec-tacles/gateway/stats"
+	"github.com/spec-tacles/go/broker"
+)
+
+// Overflow policies for the publish queue
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop_oldest"
+	OverflowSpill      = "spill"
+)
+
+// Bounds of the time waited between attempts to replay spilled events
+const (
+	minReplayBackoff = time.Second
+	maxReplayBackoff = 30 * time.Second
+)
+
+// publication is an event waiting to be published
+type publication struct {
+	event string
+	data  []byte
+
+	// events are published with their key, or under the event of their partition, if partitions
+	// is set
+	key        string
+	partitions int
+}
+
+// publishQueue publishes events to a broker from worker goroutines so that slow publishes don't
+// stall shards. Events with the same order key are published by the same worker, in order. If a
+// spill buffer is configured, events that can't be published are written to it and replayed in
+// order; until it's empty, new events are written to it as well.
+type publishQueue struct {
+	m       *Manager
+	ctx     context.Context
+	broker  broker.Broker
+	workers []*publishWorker
+	spill   *spill
+
+	// partitionKey is the field events are partitioned by, if the broker can partition them
+	partitionKey string
+}
+
+// newPublishQueue starts the workers of a publish queue
+func newPublishQueue(ctx context.Context, m *Manager, b broker.Broker) *publishQueue {
+	q := &publishQueue{
+		m:       m,
+		ctx:     ctx,
+		broker:  b,
+		workers: make([]*publishWorker, m.opts.PublishWorkers),
+
+		partitionKey: m.brokerPartitionKey(b),
+	}
+
+	if m.opts.SpillDir != "" {
+		s, err := newSpill(m.opts.SpillDir, m.opts.SpillMaxSize)
+		if err != nil {
+			m.log(LogLevelError, "unable to open spill buffer, events that can't be published will be lost: %s", err)
+		} else {
+			q.spill = s
+			go q.replay()
+		}
+	}
+
+	for i := range q.workers {
+		w := &publishWorker{
+			queue: make(chan *publication, m.opts.PublishQueueSize),
+			busy:  make(chan struct{}, 1),
+		}
+		q.workers[i] = w
+		go q.work(w)
+	}
+	return q
+}
+
+// publishWorker is the queue of a goroutine publishing events
+type publishWorker struct {
+	queue chan *publication
+
+	// busy is held by the worker from taking an event off the queue until it has been published
+	// or spilled, and while the queue is spilled when it overflows, so that events are spilled in
+	// order
+	busy chan struct{}
+}
+
+// push queues an event after the events with the same order key. If the queue is full, it
+// blocks, drops the oldest event or spills the queued events followed by this one depending on
+// the overflow policy.
+func (q *publishQueue) push(order string, p *publication) {
+	q.m.publishes.Add(1)
+	stats.PublishQueueDepth.Inc()
+
+	w := q.workers[Partition(order, len(q.workers))]
+	queue := w.queue
+	switch {
+	case q.m.opts.PublishOverflow == OverflowSpill && q.spill != nil:
+		select {
+		case queue <- p:
+		case w.busy <- struct{}{}:
+			q.overflow(w, p)
+			<-w.busy
+		}
+		return
+
+	case q.m.opts.PublishOverflow != OverflowDropOldest:
+		queue <- p
+		return
+	}
+
+	for {
+		select {
+		case queue <- p:
+			return
+		default:
+		}
+
+		select {
+		case <-queue:
+			stats.PublishQueueDepth.Dec()
+			stats.PublishesDropped.Inc()
+			q.m.publishes.Done()
+		default:
+		}
+	}
+}
+
+// overflow spills the events in a worker's queue followed by an event that doesn't fit in it, so
+// that they're replayed in order. The worker must be held busy.
+func (q *publishQueue) overflow(w *publishWorker, p *publication) {
+	// the worker may have made room before it was held
+	select {
+	case w.queue <- p:
+		return
+	default:
+	}
+
+	for drained := false; !drained; {
+		select {
+		case queued := <-w.queue:
+			stats.PublishQueueDepth.Dec()
+			q.spillEvent(queued, true)
+			q.m.publishes.Done()
+		default:
+			drained = true
+		}
+	}
+
+	stats.PublishQueueDepth.Dec()
+	q.spillEvent(p, true)
+	q.m.publishes.Done()
+}
+
+// work publishes the events in a worker's queue
+func (q *publishQueue) work(w *publishWorker) {
+	for {
+		w.busy <- struct{}{}
+		p := <-w.queue
+		stats.PublishQueueDepth.Dec()
+
+		if q.spill == nil || !q.spillEvent(p, false) {
+			start := time.Now()
+			err := q.publish(p)
+			stats.PublishLatency.Observe(time.Since(start).Seconds())
+
+			if err != nil && (q.spill == nil || !q.spillEvent(p, true)) {
+				q.m.log(LogLevelError, "failed to publish %s to broker: %s", p.event, err)
+			}
+		}
+
+		<-w.busy
+		q.m.publishes.Done()
+	}
+}
+
+// spillEvent writes an event to the spill buffer, if it has events waiting to be replayed or
+// force is set. It returns whether the event was handled by the spill buffer: events that can't be
+// written are dropped.
+func (q *publishQueue) spillEvent(p *publication, force bool) bool {
+	ok, err := q.spill.write(p, force)
+	if err != nil {
+		stats.PublishesDropped.Inc()
+		q.m.log(LogLevelError, "failed to spill %s, dropping it: %s", p.event, err)
+		return true
+	}
+	return ok
+}
+
+// replay publishes spilled events in order, retrying with backoff while the broker is unavailable
+func (q *publishQueue) replay() {
+	backoff := minReplayBackoff
+	for {
+		p, err := q.spill.next()
+		if errors.Is(err, ErrSpillCorrupt) {
+			q.m.log(LogLevelError, "%s", err)
+			continue
+		}
+
+		if err != nil {
+			q.m.log(LogLevelError, "failed to read spilled event: %s", err)
+			time.Sleep(backoff)
+			continue
+		}
+
+		for {
+			start := time.Now()
+			err = q.publish(p)
+			stats.PublishLatency.Observe(time.Since(start).Seconds())
+			if err == nil {
+				break
+			}
+
+			q.m.log(LogLevelWarn, "failed to replay spilled %s, retrying in %s: %s", p.event, backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxReplayBackoff)
+		}
+
+		backoff = minReplayBackoff
+		q.spill.commit()
+	}
+}
+
+func (q *publishQueue) publish(p *publication) error {
+	if p.partitions == 0 {
+		return q.broker.Publish(q.ctx, p.event, p.data)
+	}
+
+	if kp, ok := q.broker.(KeyedPublisher); ok {
+		return kp.PublishKeyed(q.ctx, p.event, p.key, p.data)
+	}
+	return q.broker.Publish(q.ctx, PartitionTopic(p.event, p.key, p.partitions), p.data)
+}
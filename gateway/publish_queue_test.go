@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+func TestPublishQueueOverflowSpill(t *testing.T) {
+	m := NewManager(&ManagerOptions{
+		ShardOptions:     &ShardOptions{Identify: &types.Identify{}},
+		PublishWorkers:   1,
+		PublishQueueSize: 2,
+		PublishOverflow:  OverflowSpill,
+		LogLevel:         LogLevelSuppress,
+	})
+
+	s := openSpill(t, t.TempDir())
+	b := newFakeBroker()
+	w := &publishWorker{queue: make(chan *publication, 2), busy: make(chan struct{}, 1)}
+	q := &publishQueue{m: m, ctx: context.Background(), broker: b, workers: []*publishWorker{w}, spill: s}
+
+	event := func(i int) *publication {
+		e := fmt.Sprintf("EVENT_%d", i)
+		return &publication{event: e, key: e, data: []byte(`{"event":"` + e + `"}`)}
+	}
+
+	// the worker isn't running, so the third event overflows the queue
+	for i := range 3 {
+		q.push("0", event(i))
+	}
+
+	if len(w.queue) != 0 {
+		t.Fatalf("%d events were left queued after overflowing", len(w.queue))
+	}
+
+	if got := replayEvents(t, s, 3); !slices.Equal(got, []string{"EVENT_0", "EVENT_1", "EVENT_2"}) {
+		t.Errorf("spilled %v", got)
+	}
+
+	// once restarted, the spilled events are replayed again, followed by events spilled since
+	q.spill = openSpill(t, s.dir)
+	go q.work(w)
+	q.push("0", event(3))
+	go q.replay()
+
+	var events []string
+	for len(events) < 4 {
+		select {
+		case p := <-b.published:
+			events = append(events, p.event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only published %v", events)
+		}
+	}
+
+	want := []string{"EVENT_0", "EVENT_1", "EVENT_2", "EVENT_3"}
+	if !slices.Equal(events, want) {
+		t.Errorf("published %v, want %v", events, want)
+	}
+}
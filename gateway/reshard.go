@@ -0,0 +1,390 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// reshardPollInterval is the interval at which resharding checks whether the new shards are ready
+const reshardPollInterval = time.Second
+
+// shardSet is a set of shards spawned at the same shard count. The manager runs one set at a
+// time, except while resharding, when a new set is started alongside it.
+type shardSet struct {
+	count  int
+	ids    []int
+	shards map[int]*Shard
+	runs   map[int]*shardRun
+
+	// dead contains the shards that died and were released to other processes by the coordinator
+	dead map[int]struct{}
+	// running contains the shards whose goroutines are running, including ones that were stopped
+	// but are still storing their sessions
+	running map[int]struct{}
+
+	// store, if set, keeps the sessions of a new set apart from those of the set it replaces
+	store *stagedShardStore
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// currentSet returns the set of shards the manager is running; the shards lock must be held
+func (m *Manager) currentSet() *shardSet {
+	if m.set != nil {
+		return m.set
+	}
+
+	set := &shardSet{
+		count:   m.opts.ShardCount,
+		ids:     m.ids,
+		shards:  m.Shards,
+		runs:    m.runs,
+		dead:    make(map[int]struct{}),
+		running: make(map[int]struct{}),
+	}
+
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	set.ctx, set.cancel = context.WithCancel(ctx)
+	return set
+}
+
+// shardCount returns the total number of shards
+func (m *Manager) shardCount() int {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	return m.opts.ShardCount
+}
+
+// Reshard starts a new set of shards with the given total, or Discord's recommended shard count
+// if 0, alongside the current shards. Once every new shard is ready, the new shards replace the
+// current ones, which are closed without invalidating their sessions. Resharding isn't supported
+// with explicit shard IDs or a shard coordinator.
+func (m *Manager) Reshard(count int) (err error) {
+	m.shardsMu.Lock()
+	switch {
+	case m.set == nil || m.set.ctx.Err() != nil:
+		err = ErrManagerStopped
+	case len(m.opts.ShardIDs) != 0 || m.opts.ShardCoordinator != nil:
+		err = ErrReshardUnsupported
+	case m.resharding:
+		err = ErrReshardInProgress
+	}
+
+	if err != nil {
+		m.shardsMu.Unlock()
+		return
+	}
+
+	m.resharding = true
+	ctx, current := m.ctx, m.set.count
+	m.shardsMu.Unlock()
+
+	defer func() {
+		m.shardsMu.Lock()
+		m.resharding = false
+		m.shardsMu.Unlock()
+	}()
+
+	if count == 0 {
+		g, err := m.refreshGateway()
+		if err != nil {
+			return err
+		}
+		count = g.Shards
+	}
+
+	if count == current {
+		m.log(LogLevelInfo, "Already running %d shard(s) in total", count)
+		return
+	}
+
+	ids, err := m.shardIDs(count)
+	if err != nil {
+		return
+	}
+
+	set := &shardSet{
+		count:   count,
+		ids:     ids,
+		shards:  make(map[int]*Shard, len(ids)),
+		runs:    make(map[int]*shardRun, len(ids)),
+		dead:    make(map[int]struct{}),
+		running: make(map[int]struct{}, len(ids)),
+	}
+	set.ctx, set.cancel = context.WithCancel(ctx)
+	if m.opts.ShardOptions.Store != nil {
+		set.store = newStagedShardStore(m.opts.ShardOptions.Store)
+	}
+
+	m.log(LogLevelInfo, "Resharding from %d to %d shard(s): starting %d shard(s)", current, count, len(ids))
+	m.shardsMu.Lock()
+	for _, id := range ids {
+		if !m.runShard(set, id) {
+			m.shardsMu.Unlock()
+			m.stopSet(set)
+			return ErrManagerStopped
+		}
+	}
+	m.shardsMu.Unlock()
+
+	if err = m.waitReady(set); err != nil {
+		m.log(LogLevelError, "Unable to reshard to %d shard(s): %s", count, err)
+		m.stopSet(set)
+		return
+	}
+
+	m.shardsMu.Lock()
+	old := m.set
+	m.set = set
+	m.Shards, m.runs = set.shards, set.runs
+	m.opts.ShardCount = count
+	m.shardsMu.Unlock()
+
+	m.setShardIDs(ids)
+
+	m.log(LogLevelInfo, "All %d new shard(s) are ready: closing %d old shard(s)", len(ids), len(old.shards))
+	m.stopSet(old)
+
+	if set.store != nil {
+		if err = set.store.promote(context.WithoutCancel(ctx), ids); err != nil {
+			m.log(LogLevelError, "Unable to store sessions of new shards: %s", err)
+		}
+	}
+
+	m.log(LogLevelInfo, "Resharded to %d shard(s)", count)
+	return
+}
+
+// reshardRequired reshards after a shard of the given set was closed because Discord requires
+// more shards, unless the set has already been replaced
+func (m *Manager) reshardRequired(set *shardSet) {
+	defer m.untrack()
+
+	m.shardsMu.RLock()
+	current := m.set == set
+	m.shardsMu.RUnlock()
+
+	if !current {
+		return
+	}
+
+	g, err := m.refreshGateway()
+	if err != nil {
+		m.log(LogLevelError, "Unable to fetch recommended shard count: %s", err)
+		return
+	}
+
+	// the recommendation may not have caught up with the requirement yet
+	err = m.Reshard(max(g.Shards, set.count+1))
+	if err != nil && !errors.Is(err, ErrReshardInProgress) {
+		m.log(LogLevelError, "Unable to reshard: %s", err)
+	}
+}
+
+// checkShardCount reshards whenever Discord recommends more shards than are running, checking at
+// the reshard interval until the context is done
+func (m *Manager) checkShardCount(ctx context.Context) {
+	defer m.untrack()
+
+	t := time.NewTicker(m.opts.ReshardInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		g, err := m.refreshGateway()
+		if err != nil {
+			m.log(LogLevelWarn, "Unable to fetch recommended shard count: %s", err)
+			continue
+		}
+
+		if count := m.shardCount(); g.Shards > count {
+			m.log(LogLevelInfo, "Discord recommends %d shard(s), up from %d", g.Shards, count)
+
+			err = m.Reshard(g.Shards)
+			if err != nil && !errors.Is(err, ErrReshardInProgress) {
+				m.log(LogLevelError, "Unable to reshard: %s", err)
+			}
+		}
+	}
+}
+
+// waitReady waits until every shard of a set is ready. It fails if a shard dies or the set is
+// stopped first.
+func (m *Manager) waitReady(set *shardSet) error {
+	t := time.NewTicker(reshardPollInterval)
+	defer t.Stop()
+
+	for {
+		ready := 0
+
+		m.shardsMu.RLock()
+		for id, s := range set.shards {
+			switch s.Status() {
+			case ShardStateReady:
+				ready++
+			case ShardStateDead:
+				m.shardsMu.RUnlock()
+				return fmt.Errorf("%w: shard %d died", ErrReshardAborted, id)
+			}
+		}
+		m.shardsMu.RUnlock()
+
+		if ready == len(set.ids) {
+			return nil
+		}
+
+		select {
+		case <-set.ctx.Done():
+			return ErrReshardAborted
+		case <-t.C:
+		}
+	}
+}
+
+// stopSet closes every shard of a set without invalidating their sessions and waits for them to
+// store their sessions
+func (m *Manager) stopSet(set *shardSet) {
+	set.cancel()
+	set.wg.Wait()
+}
+
+// stagedShardStore keeps the sessions of shards in memory until they're promoted, after which it
+// stores them in the target store. This keeps new shards from overwriting the sessions of the
+// shards with the same IDs that they replace.
+type stagedShardStore struct {
+	mu       sync.RWMutex
+	local    *LocalShardStore
+	target   ShardStore
+	promoted bool
+}
+
+func newStagedShardStore(target ShardStore) *stagedShardStore {
+	return &stagedShardStore{
+		local:  NewLocalShardStore(),
+		target: target,
+	}
+}
+
+// store returns the store that sessions are currently kept in; the read lock must be held
+func (s *stagedShardStore) store() ShardStore {
+	if s.promoted {
+		return s.target
+	}
+	return s.local
+}
+
+// GetSeq gets the current sequence of the given shard
+func (s *stagedShardStore) GetSeq(ctx context.Context, shardID uint) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().GetSeq(ctx, shardID)
+}
+
+// SetSeq sets the current sequence of the given shard
+func (s *stagedShardStore) SetSeq(ctx context.Context, shardID uint, seq uint) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().SetSeq(ctx, shardID, seq)
+}
+
+// GetSession gets the session identifier for the given shard
+func (s *stagedShardStore) GetSession(ctx context.Context, shardID uint) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().GetSession(ctx, shardID)
+}
+
+// SetSession sets the session identifier for the given shard
+func (s *stagedShardStore) SetSession(ctx context.Context, shardID uint, session string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().SetSession(ctx, shardID, session)
+}
+
+// GetResumeURL gets the URL to resume the session of the given shard with
+func (s *stagedShardStore) GetResumeURL(ctx context.Context, shardID uint) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().GetResumeURL(ctx, shardID)
+}
+
+// SetResumeURL sets the URL to resume the session of the given shard with
+func (s *stagedShardStore) SetResumeURL(ctx context.Context, shardID uint, url string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().SetResumeURL(ctx, shardID, url)
+}
+
+// GetUpdatedAt gets when the session of the given shard was last stored
+func (s *stagedShardStore) GetUpdatedAt(ctx context.Context, shardID uint) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().GetUpdatedAt(ctx, shardID)
+}
+
+// ClearSession forgets the session of the given shard
+func (s *stagedShardStore) ClearSession(ctx context.Context, shardID uint) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().ClearSession(ctx, shardID)
+}
+
+// promote copies the sessions of the given shards to the target store, replacing those of the
+// shards they replaced, and stores them there from now on
+func (s *stagedShardStore) promote(ctx context.Context, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.promoted = true
+
+	var errs []error
+	for _, id := range ids {
+		shardID := uint(id)
+		seq, _ := s.local.GetSeq(ctx, shardID)
+		session, _ := s.local.GetSession(ctx, shardID)
+		resumeURL, _ := s.local.GetResumeURL(ctx, shardID)
+
+		// sequences are only ever raised, but the new session's may be lower than the old one's
+		if err := s.target.ClearSession(ctx, shardID); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+			continue
+		}
+
+		if err := s.target.SetResumeURL(ctx, shardID, resumeURL); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+			continue
+		}
+
+		if err := s.target.SetSession(ctx, shardID, session); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+			continue
+		}
+
+		if err := s.target.SetSeq(ctx, shardID, seq); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import "fmt"
+
+// ShardRouter determines which shards a SEND packet is sent to
+type ShardRouter interface {
+	Route(p *UnknownSendPacket, shardCount int) ([]int, error)
+}
+
+// ShardRouterFunc adapts a function to a ShardRouter
+type ShardRouterFunc func(p *UnknownSendPacket, shardCount int) ([]int, error)
+
+// Route calls f
+func (f ShardRouterFunc) Route(p *UnknownSendPacket, shardCount int) ([]int, error) {
+	return f(p, shardCount)
+}
+
+// DefaultShardRouter sends broadcast packets to every shard, packets with a shard ID to that
+// shard, and other packets to the shard of their guild. Packets without a guild are sent to
+// shard 0, which receives direct messages.
+type DefaultShardRouter struct{}
+
+// Route implements ShardRouter
+func (DefaultShardRouter) Route(p *UnknownSendPacket, shardCount int) ([]int, error) {
+	switch {
+	case p.Broadcast:
+		ids := make([]int, shardCount)
+		for id := range ids {
+			ids[id] = id
+		}
+		return ids, nil
+
+	case p.ShardID != nil:
+		id := *p.ShardID
+		if id < 0 || id >= shardCount {
+			return nil, fmt.Errorf("%w: %d is out of range for %d shard(s)", ErrInvalidShardID, id, shardCount)
+		}
+		return []int{id}, nil
+
+	default:
+		return []int{GuildShard(p.GuildID, shardCount)}, nil
+	}
+}
+
+// GuildShard returns the ID of the shard that receives events for the given guild
+func GuildShard(guildID uint64, shardCount int) int {
+	return int((guildID >> 22) % uint64(shardCount))
+}
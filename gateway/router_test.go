@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestGuildShard(t *testing.T) {
+	tests := []struct {
+		guildID    uint64
+		shardCount int
+		want       int
+	}{
+		{0, 1, 0},
+		{41771983423143936, 1, 0},
+		{41771983423143936, 5, 4},
+		{41771983423143936, 16, 6},
+		{41771983423143936, 1000, 934},
+		{175928847299117063, 5, 1},
+		{175928847299117063, 1000, 796},
+		{81384788765712384, 16, 2},
+		{1<<64 - 1, 3, int((1<<64 - 1) >> 22 % 3)},
+	}
+
+	for _, tt := range tests {
+		if got := GuildShard(tt.guildID, tt.shardCount); got != tt.want {
+			t.Errorf("GuildShard(%d, %d) = %d, want %d", tt.guildID, tt.shardCount, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultShardRouter(t *testing.T) {
+	tests := []struct {
+		name       string
+		packet     string
+		shardCount int
+		want       []int
+		err        error
+	}{
+		{"guild", `{"guild_id":"41771983423143936","packet":{"op":8}}`, 16, []int{6}, nil},
+		{"guild single shard", `{"guild_id":"41771983423143936","packet":{"op":8}}`, 1, []int{0}, nil},
+		{"no guild", `{"packet":{"op":3}}`, 16, []int{0}, nil},
+		{"broadcast", `{"broadcast":true,"packet":{"op":3}}`, 4, []int{0, 1, 2, 3}, nil},
+		{"broadcast single shard", `{"broadcast":true,"packet":{"op":3}}`, 1, []int{0}, nil},
+		{"broadcast overrides guild and shard", `{"broadcast":true,"guild_id":"41771983423143936","shard_id":1,"packet":{"op":3}}`, 2, []int{0, 1}, nil},
+		{"shard", `{"shard_id":3,"packet":{"op":3}}`, 4, []int{3}, nil},
+		{"shard 0", `{"shard_id":0,"packet":{"op":3}}`, 4, []int{0}, nil},
+		{"shard overrides guild", `{"shard_id":1,"guild_id":"41771983423143936","packet":{"op":8}}`, 16, []int{1}, nil},
+		{"unknown shard", `{"shard_id":4,"packet":{"op":3}}`, 4, nil, ErrInvalidShardID},
+		{"negative shard", `{"shard_id":-1,"packet":{"op":3}}`, 4, nil, ErrInvalidShardID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &UnknownSendPacket{}
+			if err := json.Unmarshal([]byte(tt.packet), p); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := DefaultShardRouter{}.Route(p, tt.shardCount)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got shards %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardRouterFunc(t *testing.T) {
+	var router ShardRouter = ShardRouterFunc(func(p *UnknownSendPacket, shardCount int) ([]int, error) {
+		return []int{shardCount - 1}, nil
+	})
+
+	got, err := router.Route(&UnknownSendPacket{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(got, []int{2}) {
+		t.Errorf("got shards %v, want [2]", got)
+	}
+}
@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"sync"
+
+	"github.com/spec-tacles/gateway/stats"
+)
+
+// seqWindow is the number of recent sequences remembered to tell duplicates from dispatches that
+// arrive out of order
+const seqWindow = 1024
+
+// seqTracker tracks the sequences of the dispatches received in a session
+type seqTracker struct {
+	mu   sync.Mutex
+	last uint64
+	seen [seqWindow / 64]uint64
+}
+
+// seqResult describes a dispatch's sequence compared to the previous dispatches in its session
+type seqResult int
+
+const (
+	seqInOrder seqResult = iota
+	seqGap
+	seqDuplicate
+	seqOutOfOrder
+)
+
+// reset starts tracking a new session
+func (t *seqTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.last = 0
+	t.seen = [seqWindow / 64]uint64{}
+}
+
+// resume starts tracking a resumed session from the given sequence, unless the session is
+// already being tracked
+func (t *seqTracker) resume(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == 0 && seq != 0 {
+		t.last = seq
+		t.mark(seq)
+	}
+}
+
+// check records a sequence. For gaps, it also returns the highest sequence received before it.
+func (t *seqTracker) check(seq uint64) (result seqResult, last uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last = t.last
+	switch {
+	case last == 0 || seq == last+1:
+		result = seqInOrder
+	case seq > last:
+		result = seqGap
+	case last-seq >= seqWindow || t.marked(seq):
+		return seqDuplicate, last
+	default:
+		t.mark(seq)
+		return seqOutOfOrder, last
+	}
+
+	// forget sequences that were skipped, which are still in the window from its last use
+	for s := max(last+1, seq-min(seq, seqWindow-1)); s < seq; s++ {
+		t.seen[s%seqWindow/64] &^= 1 << (s % 64)
+	}
+
+	t.last = seq
+	t.mark(seq)
+	return
+}
+
+func (t *seqTracker) mark(seq uint64) {
+	t.seen[seq%seqWindow/64] |= 1 << (seq % 64)
+}
+
+func (t *seqTracker) marked(seq uint64) bool {
+	return t.seen[seq%seqWindow/64]&(1<<(seq%64)) != 0
+}
+
+// checkSeq checks the sequence of a dispatch against the previous dispatches in this session,
+// recording and logging gaps, duplicates and dispatches that arrive out of order. It returns
+// whether the dispatch should be suppressed as a duplicate.
+func (s *Shard) checkSeq(seq uint64) (suppress bool) {
+	result, last := s.seqs.check(seq)
+	switch result {
+	case seqGap:
+		stats.DispatchGaps.WithLabelValues(s.id).Inc()
+		stats.DispatchesMissed.WithLabelValues(s.id).Add(float64(seq - last - 1))
+		if seq-last == 2 {
+			s.log(LogLevelWarn, "Missed dispatch %d", last+1)
+		} else {
+			s.log(LogLevelWarn, "Missed dispatches %d to %d", last+1, seq-1)
+		}
+
+	case seqDuplicate:
+		stats.DuplicateDispatches.WithLabelValues(s.id).Inc()
+		s.log(LogLevelDebug, "Received duplicate dispatch %d", seq)
+		return s.opts.SuppressDuplicates
+
+	case seqOutOfOrder:
+		stats.OutOfOrderDispatches.WithLabelValues(s.id).Inc()
+		s.log(LogLevelWarn, "Received dispatch %d out of order after %d", seq, last)
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import "testing"
+
+// seqStep is a step of a seqTracker test: checking a sequence, resuming from one, or identifying
+type seqStep struct {
+	seq  uint64
+	want seqResult
+
+	resume, identify bool
+}
+
+func checkStep(seq uint64, want seqResult) seqStep { return seqStep{seq: seq, want: want} }
+func resumeStep(seq uint64) seqStep                { return seqStep{seq: seq, resume: true} }
+func identifyStep() seqStep                        { return seqStep{identify: true} }
+
+// inOrderSteps returns steps checking the sequences from first to last in order
+func inOrderSteps(first, last uint64) []seqStep {
+	steps := make([]seqStep, 0, last-first+1)
+	for seq := first; seq <= last; seq++ {
+		steps = append(steps, checkStep(seq, seqInOrder))
+	}
+	return steps
+}
+
+func TestSeqTracker(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []seqStep
+	}{
+		{"in order", inOrderSteps(1, 5)},
+		{"first dispatch", []seqStep{checkStep(7, seqInOrder), checkStep(8, seqInOrder)}},
+		{"gap", []seqStep{checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(5, seqGap), checkStep(6, seqInOrder)}},
+		{"duplicates", []seqStep{
+			checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(3, seqInOrder),
+			checkStep(3, seqDuplicate), checkStep(2, seqDuplicate), checkStep(1, seqDuplicate),
+		}},
+		{"out of order", []seqStep{
+			checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(5, seqGap),
+			checkStep(4, seqOutOfOrder), checkStep(3, seqOutOfOrder), checkStep(4, seqDuplicate), checkStep(6, seqInOrder),
+		}},
+		{"edge of window", []seqStep{
+			checkStep(1, seqInOrder), checkStep(2000, seqGap),
+			checkStep(976, seqDuplicate), checkStep(977, seqOutOfOrder), checkStep(977, seqDuplicate),
+		}},
+		{"wraparound", append(inOrderSteps(1, 1030),
+			checkStep(7, seqDuplicate), checkStep(6, seqDuplicate), checkStep(1031, seqInOrder),
+		)},
+		{"gap wider than window", []seqStep{
+			checkStep(1, seqInOrder), checkStep(1030, seqGap),
+			checkStep(7, seqOutOfOrder), checkStep(7, seqDuplicate), checkStep(6, seqDuplicate), checkStep(1, seqDuplicate),
+		}},
+		{"gap clears stale sequences", []seqStep{
+			checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(3, seqInOrder), checkStep(1026, seqGap),
+			checkStep(1025, seqOutOfOrder), checkStep(1024, seqOutOfOrder), checkStep(3, seqDuplicate),
+		}},
+		{"identify", []seqStep{
+			checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(3, seqInOrder),
+			identifyStep(), checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(2, seqDuplicate),
+		}},
+		{"identify after gap", []seqStep{
+			checkStep(1, seqInOrder), checkStep(5, seqGap), identifyStep(), checkStep(3, seqInOrder), checkStep(4, seqInOrder),
+		}},
+		{"resume", []seqStep{resumeStep(10), checkStep(11, seqInOrder), checkStep(10, seqDuplicate), checkStep(9, seqOutOfOrder)}},
+		{"resume with gap", []seqStep{resumeStep(10), checkStep(13, seqGap), checkStep(12, seqOutOfOrder)}},
+		{"resume from nothing", []seqStep{resumeStep(0), checkStep(5, seqInOrder), checkStep(6, seqInOrder)}},
+		{"resume tracked session", []seqStep{
+			checkStep(1, seqInOrder), checkStep(2, seqInOrder), checkStep(3, seqInOrder),
+			resumeStep(2), checkStep(3, seqDuplicate), checkStep(4, seqInOrder),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				tracker seqTracker
+				last    uint64
+			)
+
+			for i, step := range tt.steps {
+				switch {
+				case step.identify:
+					tracker.reset()
+					last = 0
+					continue
+				case step.resume:
+					tracker.resume(step.seq)
+					if last == 0 {
+						last = step.seq
+					}
+					continue
+				}
+
+				result, got := tracker.check(step.seq)
+				if result != step.want || got != last {
+					t.Errorf("step %d: check(%d) = %d after %d, want %d after %d", i, step.seq, result, got, step.want, last)
+				}
+
+				if result == seqInOrder || result == seqGap {
+					last = step.seq
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/spec-tacles/gateway/stats"
+)
+
+// sessionLimiter tracks the daily session start limit and blocks identifies once the remaining
+// budget falls to the configured reserve, until Discord resets the limit
+type sessionLimiter struct {
+	m   *Manager
+	mux sync.Mutex
+
+	total     int
+	remaining int
+	resetsAt  time.Time
+}
+
+// newSessionLimiter creates a session limiter from the given gateway information
+func newSessionLimiter(m *Manager, g *GatewayBot) *sessionLimiter {
+	l := &sessionLimiter{m: m}
+	l.update(g.SessionStartLimit)
+	return l
+}
+
+// Lock blocks until a session start is available and consumes it. The limit is refreshed and
+// waited on without holding the lock, so that cancelling one shard's identify doesn't hold up others.
+func (l *sessionLimiter) Lock(ctx context.Context) error {
+	for {
+		if l.take() {
+			return nil
+		}
+
+		// other processes may share this token, so get the real value before waiting
+		wait := time.Minute
+		if g, err := l.m.refreshGateway(); err != nil {
+			l.m.log(LogLevelError, "Unable to refresh session start limit: %s", err)
+		} else if wait = l.refresh(g.SessionStartLimit); wait == 0 {
+			continue
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// take consumes a session start if the remaining budget is above the reserve
+func (l *sessionLimiter) take() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.remaining <= l.m.opts.SessionStartReserve {
+		return false
+	}
+
+	l.remaining--
+	stats.SessionStartsRemaining.Set(float64(l.remaining))
+	return true
+}
+
+// refresh updates the budget with the given session start limit and returns how long to wait
+// before it resets, or zero if session starts are available
+func (l *sessionLimiter) refresh(limit SessionStartLimit) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.update(limit)
+	if l.remaining > l.m.opts.SessionStartReserve {
+		return 0
+	}
+
+	wait := time.Until(l.resetsAt)
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	l.m.log(LogLevelError, "Session start limit exhausted (%d/%d remaining): delaying identify for %s", l.remaining, l.total, wait)
+	return wait
+}
+
+// update replaces the tracked budget with the given session start limit; the lock must be held
+func (l *sessionLimiter) update(limit SessionStartLimit) {
+	resetAfter := time.Duration(limit.ResetAfter) * time.Millisecond
+
+	l.total = limit.Total
+	l.remaining = limit.Remaining
+	l.resetsAt = time.Now().Add(resetAfter)
+
+	stats.SessionStartsTotal.Set(float64(l.total))
+	stats.SessionStartsRemaining.Set(float64(l.remaining))
+
+	// warn once the budget runs low, rather than after every identify
+	if l.remaining <= l.m.opts.SessionStartReserve+l.total/10 && resetAfter > 0 {
+		l.m.log(LogLevelWarn, "%d/%d session starts remaining, resetting in %s", l.remaining, l.total, resetAfter)
+	}
+}
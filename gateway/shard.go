@@ -8,32 +8,53 @@ import (
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/spec-tacles/gateway/compression"
+	"github.com/spec-tacles/gateway/etf"
 	"github.com/spec-tacles/gateway/stats"
 	"github.com/spec-tacles/go/types"
 )
 
 // Shard represents a Gateway shard
 type Shard struct {
-	Gateway *types.GatewayBot
-	Ping    time.Duration
+	Gateway *GatewayBot
 
 	conn *Connection
 
-	id            string
-	opts          *ShardOptions
-	limiter       Limiter
-	packets       *sync.Pool
-	lastHeartbeat time.Time
-	resumeURL     string
+	id      string
+	opts    *ShardOptions
+	limiter Limiter
+	packets *sync.Pool
 
 	connMu sync.Mutex
 	acks   chan struct{}
+
+	state atomic.Int32
+
+	// latest session state, persisted on shutdown
+	seq       atomic.Uint64
+	sessionID atomic.Pointer[string]
+	seqs      seqTracker
+	resumeURL atomic.Pointer[string]
+	// seqStored is when the sequence was last stored, in nanoseconds
+	seqStored atomic.Int64
+
+	// heartbeat state in nanoseconds, used to determine health
+	heartbeatInterval atomic.Int64
+	lastHeartbeat     atomic.Int64
+	lastAck           atomic.Int64
+	ping              atomic.Int64
 }
 
+// flushTimeout is the time allowed for persisting session state on shutdown
+const flushTimeout = 5 * time.Second
+
+// seqStoreInterval is the longest time heartbeats go without storing the sequence
+const seqStoreInterval = 10 * time.Second
+
 // NewShard creates a new Gateway shard
 func NewShard(opts *ShardOptions) *Shard {
 	opts.init()
@@ -47,18 +68,70 @@ func NewShard(opts *ShardOptions) *Shard {
 			},
 		},
 		id:   strconv.Itoa(opts.Identify.Shard[0]),
-		acks: make(chan struct{}),
-		resumeURL: "",
+		acks: make(chan struct{}, 1),
 	}
 }
 
-// Open starts a new session. Any errors are fatal.
+// Open starts a new session, reconnecting with backoff according to the Retryer. Any errors are
+// fatal. When the context is canceled, the connection is closed such that the session remains
+// resumable and Open returns nil.
 func (s *Shard) Open(ctx context.Context) (err error) {
-	err = s.connect(ctx)
-	for s.handleClose(err) {
+	var (
+		timeout time.Duration
+		retries int
+	)
+
+	defer func() {
+		if err != nil {
+			s.setState(ShardStateDead)
+		} else {
+			s.setState(ShardStateStopped)
+		}
+	}()
+
+	if !compression.Supported(s.opts.Compression) {
+		return fmt.Errorf("%w: %s", compression.ErrUnsupported, s.opts.Compression)
+	}
+
+	if s.opts.Encoding != EncodingJSON && s.opts.Encoding != EncodingETF {
+		return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, s.opts.Encoding)
+	}
+
+	for {
 		err = s.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if !s.handleClose(err) {
+			if websocket.IsCloseError(err, types.CloseAuthenticationFailed) {
+				if err := s.clearSession(context.WithoutCancel(ctx)); err != nil {
+					s.log(LogLevelError, "Unable to clear session: %s", err)
+				}
+			}
+			return
+		}
+
+		// a connection that started a session resets the backoff
+		if s.Status() == ShardStateReady || retries == 0 {
+			timeout = s.opts.Retryer.FirstTimeout()
+			retries = 0
+		} else if timeout, err = s.opts.Retryer.NextTimeout(timeout, retries); err != nil {
+			s.log(LogLevelError, "giving up after %d reconnect attempts", retries)
+			return
+		}
+		retries++
+		s.setState(ShardStateReconnecting)
+
+		wait := jitter(timeout)
+		s.log(LogLevelInfo, "reconnecting in %s (attempt %d)", wait, retries)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
 	}
-	return
 }
 
 // connect runs a single websocket connection; errors may indicate the connection is recoverable
@@ -67,45 +140,70 @@ func (s *Shard) connect(ctx context.Context) (err error) {
 		return ErrGatewayAbsent
 	}
 
-	url := s.gatewayURL()
+	sessionID, err := s.opts.Store.GetSession(ctx, s.idUint())
+	if err != nil {
+		s.log(LogLevelWarn, "Unable to retrieve session ID for login: %s", err)
+	}
+
+	if sessionID != "" && s.sessionExpired(ctx) {
+		sessionID = ""
+	}
+
+	url := s.gatewayURL(ctx, sessionID != "")
 	s.log(LogLevelInfo, "Connecting using URL: %s", url)
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	s.setState(ShardStateConnecting)
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
 		return
 	}
-	s.conn = NewConnection(conn, compression.NewZstd())
 
-	heartbeatCtx, cancelHeartbeat := context.WithCancel(ctx)
-	defer cancelHeartbeat()
-
-	err = s.expectPacket(ctx, types.GatewayOpHello, types.GatewayEventNone, s.handleHello(heartbeatCtx))
+	decompressor, err := compression.New(s.opts.Compression)
 	if err != nil {
+		ws.Close()
 		return
 	}
 
-	seq, err := s.opts.Store.GetSeq(ctx, s.idUint())
+	conn := NewConnection(ws, decompressor)
+	if s.opts.CompressSent && s.opts.Compression != compression.TypeNone {
+		if conn.compressor, err = compression.NewCompressor(s.opts.Compression); err != nil {
+			ws.Close()
+			return
+		}
+	}
+
+	s.connMu.Lock()
+	s.conn = conn
+	s.connMu.Unlock()
+	defer conn.Disconnect()
+
+	// cancelled once this connection is torn down, stopping anything waiting to use it
+	connCtx, cancelConn := context.WithCancel(ctx)
+	defer cancelConn()
+
+	err = s.expectPacket(ctx, types.GatewayOpHello, types.GatewayEventNone, s.handleHello(connCtx))
 	if err != nil {
-		s.log(LogLevelWarn, "Unable to retrive sequence data for login: %s", err)
+		return
 	}
 
-	sessionID, err := s.opts.Store.GetSession(ctx, s.idUint())
+	seq, err := s.opts.Store.GetSeq(ctx, s.idUint())
 	if err != nil {
-		s.log(LogLevelWarn, "Unable to retrieve session ID for login: %s", err)
+		s.log(LogLevelWarn, "Unable to retrive sequence data for login: %s", err)
 	}
 
 	s.log(LogLevelDebug, "session \"%s\", seq %d", sessionID, seq)
-	errs := make(chan error)
+	errs := make(chan error, 2)
 
 	go func() {
-		if sessionID == "" && seq == 0 {
-			if err = s.sendIdentify(); err != nil {
-				errs <- err
-			}
+		var err error
+		if sessionID == "" {
+			err = s.sendIdentify(connCtx, conn)
 		} else {
-			if err = s.sendResume(ctx); err != nil {
-				errs <- err
-			}
+			err = s.sendResume(ctx)
+		}
+
+		if err != nil {
+			errs <- err
 		}
 	}()
 
@@ -117,26 +215,172 @@ func (s *Shard) connect(ctx context.Context) (err error) {
 
 	go func() {
 		for {
-			err = s.readPacket(ctx, nil)
-			if err != nil {
+			if err := s.readPacket(connCtx, nil); err != nil {
 				errs <- err
 				break
 			}
 		}
 	}()
 
-	return <-errs
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		s.shutdown()
+		err = ctx.Err()
+	}
+	return
+}
+
+// shutdown closes the connection without invalidating the session and persists the latest
+// session state so that it can be resumed later
+func (s *Shard) shutdown() {
+	if err := s.CloseWithReason(websocket.CloseServiceRestart, ErrShuttingDown); err != nil {
+		s.log(LogLevelWarn, "Unable to send close frame: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	if !s.leased(ctx) {
+		s.log(LogLevelWarn, "Lease was lost: not storing session state")
+		return
+	}
+
+	if seq := s.seq.Load(); seq != 0 {
+		if err := s.opts.Store.SetSeq(ctx, s.idUint(), uint(seq)); err != nil {
+			s.log(LogLevelError, "Unable to store sequence %d: %s", seq, err)
+		}
+	}
+
+	if sessionID := s.sessionID.Load(); sessionID != nil {
+		if err := s.opts.Store.SetSession(ctx, s.idUint(), *sessionID); err != nil {
+			s.log(LogLevelError, "Unable to store session ID: %s", err)
+		}
+	}
+
+	if resumeURL := s.resumeURL.Load(); resumeURL != nil && *resumeURL != "" {
+		if err := s.opts.Store.SetResumeURL(ctx, s.idUint(), *resumeURL); err != nil {
+			s.log(LogLevelError, "Unable to store resume URL: %s", err)
+		}
+	}
+}
+
+// leased returns whether this process still holds the shard's lease, if shards are leased
+func (s *Shard) leased(ctx context.Context) bool {
+	return s.opts.leased == nil || s.opts.leased(ctx)
+}
+
+// sessionExpired returns whether the stored session was last updated longer than the session TTL
+// ago, in which case Discord has most likely discarded it. Expired sessions are cleared.
+func (s *Shard) sessionExpired(ctx context.Context) bool {
+	updated, err := s.opts.Store.GetUpdatedAt(ctx, s.idUint())
+	if err != nil {
+		s.log(LogLevelWarn, "Unable to retrieve when the session was stored: %s", err)
+		return false
+	}
+
+	age := time.Since(updated)
+	if s.opts.SessionTTL == 0 || updated.IsZero() || age <= s.opts.SessionTTL {
+		return false
+	}
+
+	s.log(LogLevelInfo, "Session was stored %s ago: identifying instead of resuming", age.Round(time.Second))
+	if err = s.clearSession(ctx); err != nil {
+		s.log(LogLevelError, "Unable to clear session: %s", err)
+	}
+	return true
+}
+
+// clearSession forgets the current session, so that the next connection identifies
+func (s *Shard) clearSession(ctx context.Context) error {
+	s.sessionID.Store(nil)
+	s.seq.Store(0)
+	s.resumeURL.Store(nil)
+	return s.opts.Store.ClearSession(ctx, s.idUint())
 }
 
 // CloseWithReason closes the connection and logs the reason
 func (s *Shard) CloseWithReason(code int, reason error) error {
+	conn := s.connection()
+	if conn == nil {
+		return ErrConnectionClosed
+	}
+
 	s.log(LogLevelWarn, "%s: closing connection", reason)
-	return s.conn.CloseWithCode(code)
+	return conn.CloseWithCode(code)
+}
+
+// connection returns the current connection, if any
+func (s *Shard) connection() *Connection {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	return s.conn
+}
+
+// Reconnect closes the current connection without invalidating the session, causing Open to
+// reconnect and resume
+func (s *Shard) Reconnect() error {
+	return s.CloseWithReason(websocket.CloseServiceRestart, ErrReconnectRequested)
+}
+
+// Reidentify invalidates the current session, causing Open to reconnect and identify
+func (s *Shard) Reidentify(ctx context.Context) error {
+	if err := s.clearSession(ctx); err != nil {
+		return err
+	}
+
+	return s.CloseWithReason(websocket.CloseNormalClosure, ErrReidentifyRequested)
+}
+
+// UpdatePresence updates the presence of this shard and the presence it identifies with from now on
+func (s *Shard) UpdatePresence(presence *types.StatusUpdate) error {
+	s.opts.presence.Store(presence)
+	return s.SendPacket(types.GatewayOpStatusUpdate, presence)
+}
+
+// ID returns the ID of this shard
+func (s *Shard) ID() int {
+	return s.opts.Identify.Shard[0]
+}
+
+// Seq returns the sequence of the last dispatch received by this shard
+func (s *Shard) Seq() uint64 {
+	return s.seq.Load()
+}
+
+// SessionID returns the ID of the session started by this shard, if any
+func (s *Shard) SessionID() string {
+	if sessionID := s.sessionID.Load(); sessionID != nil {
+		return *sessionID
+	}
+	return ""
+}
+
+// Ping returns the round trip time of the last acknowledged heartbeat
+func (s *Shard) Ping() time.Duration {
+	return time.Duration(s.ping.Load())
+}
+
+// Healthy returns whether this shard has a ready session and has recently received a heartbeat
+// ACK. A heartbeat is considered recent if it was received within two heartbeat intervals.
+func (s *Shard) Healthy() bool {
+	if s.Status() != ShardStateReady {
+		return false
+	}
+
+	since := time.Since(time.Unix(0, s.lastAck.Load()))
+	return since < 2*time.Duration(s.heartbeatInterval.Load())
 }
 
 // Close closes the current session
 func (s *Shard) Close() (err error) {
-	if err = s.conn.Close(); err != nil {
+	conn := s.connection()
+	if conn == nil {
+		return ErrConnectionClosed
+	}
+
+	if err = conn.Close(); err != nil {
 		return
 	}
 
@@ -153,7 +397,11 @@ func (s *Shard) readPacket(ctx context.Context, fn func(*types.ReceivePacket) er
 	p := s.packets.Get().(*types.ReceivePacket)
 	defer s.packets.Put(p)
 
-	err = json.Unmarshal(d, p)
+	if s.opts.Encoding == EncodingETF {
+		err = etf.DecodePacket(d, p, s.opts.RawETF)
+	} else {
+		err = json.Unmarshal(d, p)
+	}
 	if err != nil {
 		return
 	}
@@ -168,7 +416,8 @@ func (s *Shard) readPacket(ctx context.Context, fn func(*types.ReceivePacket) er
 	// record packet received
 	stats.PacketsReceived.WithLabelValues(string(p.Event), strconv.Itoa(int(p.Op)), s.id).Inc()
 
-	if s.opts.OnPacket != nil {
+	suppress := p.Op == types.GatewayOpDispatch && s.checkSeq(uint64(p.Seq))
+	if s.opts.OnPacket != nil && !suppress {
 		s.opts.OnPacket(p)
 	}
 
@@ -220,7 +469,7 @@ func (s *Shard) handlePacket(ctx context.Context, p *types.ReceivePacket) (err e
 
 	case types.GatewayOpInvalidSession:
 		resumable := new(bool)
-		if err = json.Unmarshal(p.Data, resumable); err != nil {
+		if err = s.unmarshalData(p, resumable); err != nil {
 			return
 		}
 
@@ -233,22 +482,38 @@ func (s *Shard) handlePacket(ctx context.Context, p *types.ReceivePacket) (err e
 			return
 		}
 
-		time.Sleep(time.Second * time.Duration(rand.Intn(5)+1))
-		if err = s.sendIdentify(); err != nil {
+		if err = s.clearSession(ctx); err != nil {
+			s.log(LogLevelError, "Unable to clear invalid session: %s", err)
+		}
+
+		select {
+		case <-time.After(time.Second * time.Duration(rand.Intn(5)+1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err = s.sendIdentify(ctx, s.connection()); err != nil {
 			return
 		}
 
 		s.log(LogLevelDebug, "Sent identify in response to invalid non-resumable session")
 
 	case types.GatewayOpHeartbeatACK:
-		if s.lastHeartbeat.Unix() != 0 {
+		s.lastAck.Store(time.Now().UnixNano())
+		if sent := s.lastHeartbeat.Load(); sent != 0 {
 			// record latest gateway ping
-			s.Ping = time.Since(s.lastHeartbeat)
-			stats.Ping.WithLabelValues(s.id).Observe(float64(s.Ping.Nanoseconds()) / 1e6)
+			ping := time.Since(time.Unix(0, sent))
+			s.ping.Store(int64(ping))
+			stats.Ping.WithLabelValues(s.id).Observe(float64(ping.Nanoseconds()) / 1e6)
 		}
 
-		s.log(LogLevelDebug, "Heartbeat ACK (RTT %s)", s.Ping)
-		s.acks <- struct{}{}
+		s.log(LogLevelDebug, "Heartbeat ACK (RTT %s)", s.Ping())
+
+		// the heartbeater may have already stopped if the connection is closing
+		select {
+		case s.acks <- struct{}{}:
+		default:
+		}
 	}
 
 	return
@@ -256,48 +521,72 @@ func (s *Shard) handlePacket(ctx context.Context, p *types.ReceivePacket) (err e
 
 // handleDispatch handles dispatch packets
 func (s *Shard) handleDispatch(ctx context.Context, p *types.ReceivePacket) (err error) {
+	s.seq.Store(uint64(p.Seq))
 	if err = s.opts.Store.SetSeq(ctx, s.idUint(), uint(p.Seq)); err != nil {
 		return
 	}
+	s.seqStored.Store(time.Now().UnixNano())
 
 	switch p.Event {
 	case types.GatewayEventReady:
 		r := new(types.Ready)
-		if err = json.Unmarshal(p.Data, r); err != nil {
+		if err = s.unmarshalData(p, r); err != nil {
+			return
+		}
+
+		s.resumeURL.Store(&r.ResumeGatewayURL)
+		s.sessionID.Store(&r.SessionID)
+
+		if err = s.opts.Store.SetResumeURL(ctx, s.idUint(), r.ResumeGatewayURL); err != nil {
 			return
 		}
 
-		s.resumeURL = r.ResumeGatewayURL
-		
 		if err = s.opts.Store.SetSession(ctx, s.idUint(), r.SessionID); err != nil {
 			return
 		}
 
+		s.setState(ShardStateReady)
 		s.log(LogLevelDebug, "Session ID: %s", r.SessionID)
 		s.log(LogLevelDebug, "Using version %d", r.Version)
 		s.logTrace(r.Trace)
 
 	case types.GatewayEventResumed:
 		r := new(types.Resumed)
-		if err = json.Unmarshal(p.Data, r); err != nil {
+		if err = s.unmarshalData(p, r); err != nil {
 			return
 		}
 
+		s.setState(ShardStateReady)
 		s.logTrace(r.Trace)
 	}
 
 	return
 }
 
+// unmarshalData unmarshals the data of a packet, which is still ETF-encoded if RawETF is set
+func (s *Shard) unmarshalData(p *types.ReceivePacket, v interface{}) (err error) {
+	data := []byte(p.Data)
+	if etf.IsTerm(data) {
+		if data, err = etf.ToJSON(data); err != nil {
+			return
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
 func (s *Shard) handleHello(ctx context.Context) func(*types.ReceivePacket) error {
 	return func(p *types.ReceivePacket) (err error) {
 		h := new(types.Hello)
-		if err = json.Unmarshal(p.Data, h); err != nil {
+		if err = s.unmarshalData(p, h); err != nil {
 			return
 		}
 
+		interval := time.Duration(h.HeartbeatInterval) * time.Millisecond
+		s.heartbeatInterval.Store(int64(interval))
+		s.lastAck.Store(time.Now().UnixNano())
+
 		s.logTrace(h.Trace)
-		go s.startHeartbeater(ctx, time.Duration(h.HeartbeatInterval)*time.Millisecond)
+		go s.startHeartbeater(ctx, interval)
 		return
 	}
 }
@@ -332,15 +621,34 @@ func (s *Shard) SendPacket(op types.GatewayOp, data interface{}) error {
 
 // Send sends a pre-prepared packet
 func (s *Shard) Send(p *types.SendPacket) error {
+	return s.send(context.Background(), nil, p)
+}
+
+// send sends a packet over the given connection, failing if it's no longer current; a nil
+// connection sends over the current one
+func (s *Shard) send(ctx context.Context, conn *Connection, p *types.SendPacket) error {
 	d, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 
-	s.limiter.Lock()
+	if s.opts.Encoding == EncodingETF {
+		if d, err = etf.FromJSON(d); err != nil {
+			return err
+		}
+	}
+
+	if err = s.limiter.Lock(ctx); err != nil {
+		return err
+	}
+
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
 
+	if s.conn == nil || (conn != nil && s.conn != conn) {
+		return ErrConnectionClosed
+	}
+
 	// record packet sent
 	defer stats.PacketsSent.WithLabelValues("", strconv.Itoa(int(p.Op)), s.id).Inc()
 
@@ -349,10 +657,18 @@ func (s *Shard) Send(p *types.SendPacket) error {
 	return err
 }
 
-// sendIdentify sends an identify packet
-func (s *Shard) sendIdentify() error {
-	s.opts.IdentifyLimiter.Lock()
-	return s.SendPacket(types.GatewayOpIdentify, s.opts.Identify)
+// sendIdentify sends an identify packet over the given connection once the identify limiter
+// allows it. Identifies are never sent over a later connection, which may identify or resume itself.
+func (s *Shard) sendIdentify(ctx context.Context, conn *Connection) error {
+	s.setState(ShardStateIdentifying)
+	if err := s.opts.IdentifyLimiter.Lock(ctx); err != nil {
+		return err
+	}
+	s.seqs.reset()
+
+	identify := *s.opts.Identify
+	identify.Presence = s.opts.presence.Load()
+	return s.send(ctx, conn, &types.SendPacket{Op: types.GatewayOpIdentify, Data: &identify})
 }
 
 // sendResume sends a resume packet
@@ -367,6 +683,8 @@ func (s *Shard) sendResume(ctx context.Context) error {
 		return err
 	}
 
+	s.seqs.resume(uint64(seq))
+	s.setState(ShardStateResuming)
 	s.log(LogLevelDebug, "attempting to resume session")
 	return s.SendPacket(types.GatewayOpResume, &types.Resume{
 		Token:     s.opts.Identify.Token,
@@ -377,12 +695,22 @@ func (s *Shard) sendResume(ctx context.Context) error {
 
 // sendHeartbeat sends a heartbeat packet
 func (s *Shard) sendHeartbeat(ctx context.Context) error {
+	// keep the stored session from expiring while no dispatches are received
+	stored := time.Unix(0, s.seqStored.Load())
+	if seq := s.seq.Load(); seq != 0 && time.Since(stored) >= seqStoreInterval && s.leased(ctx) {
+		if err := s.opts.Store.SetSeq(ctx, s.idUint(), uint(seq)); err != nil {
+			s.log(LogLevelWarn, "Unable to store sequence %d: %s", seq, err)
+		} else {
+			s.seqStored.Store(time.Now().UnixNano())
+		}
+	}
+
 	seq, err := s.opts.Store.GetSeq(ctx, s.idUint())
 	if err != nil {
 		return err
 	}
 
-	s.lastHeartbeat = time.Now()
+	s.lastHeartbeat.Store(time.Now().UnixNano())
 	return s.SendPacket(types.GatewayOpHeartbeat, seq)
 }
 
@@ -418,21 +746,45 @@ func (s *Shard) startHeartbeater(ctx context.Context, interval time.Duration) {
 	}
 }
 
-// gatewayURL returns the Gateway URL with appropriate query parameters
-func (s *Shard) gatewayURL() string {
+// gatewayURL returns the Gateway URL with appropriate query parameters. Sessions are resumed
+// using the URL Discord gave when they started, which is retrieved from the store if the session
+// was started by another process.
+func (s *Shard) gatewayURL(ctx context.Context, resume bool) string {
 	query := url.Values{
 		"v":        {strconv.FormatUint(uint64(s.opts.Version), 10)},
-		"encoding": {"json"},
-		"compress": {"zstd-stream"},
+		"encoding": {s.opts.Encoding},
 	}
 
-	if s.resumeURL != "" {
-		return s.resumeURL + "/?" + query.Encode()
+	if s.opts.Compression != compression.TypeNone {
+		query.Set("compress", s.opts.Compression)
+	}
+
+	resumeURL := s.resumeURL.Load()
+	if resume && (resumeURL == nil || *resumeURL == "") {
+		stored, err := s.opts.Store.GetResumeURL(ctx, s.idUint())
+		if err != nil {
+			s.log(LogLevelWarn, "Unable to retrieve resume URL: %s", err)
+		}
+
+		if s.resumeURL.CompareAndSwap(resumeURL, &stored) {
+			resumeURL = &stored
+		} else {
+			resumeURL = s.resumeURL.Load()
+		}
+	}
+
+	if resume && resumeURL != nil && *resumeURL != "" {
+		return *resumeURL + "/?" + query.Encode()
 	} else {
 		return s.Gateway.URL + "/?" + query.Encode()
 	}
 }
 
+// jitter randomizes the given duration between half and all of its value
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func (s *Shard) idUint() uint {
 	return uint(s.opts.Identify.Shard[0])
 }
@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix/v4"
+	"github.com/spec-tacles/go/broker/redis"
+)
+
+// ShardCoordinator leases shards to gateway processes so that each shard is run by one process at
+// a time. Leases expire unless they're renewed, after which another process may acquire them.
+type ShardCoordinator interface {
+	// Acquire attempts to lease the given shard, returning whether this process holds the lease
+	Acquire(ctx context.Context, shardID int) (bool, error)
+	// Renew extends the lease on the given shard, returning false if this process no longer holds it
+	Renew(ctx context.Context, shardID int) (bool, error)
+	// Release gives up the lease on the given shard, if this process holds it
+	Release(ctx context.Context, shardID int) error
+	// TTL returns how long a lease lasts unless it's renewed
+	TTL() time.Duration
+}
+
+// DefaultLeaseTTL is the default time a shard lease lasts unless it's renewed
+const DefaultLeaseTTL = 30 * time.Second
+
+var acquireLease = radix.NewEvalScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then return 0 end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+var renewLease = radix.NewEvalScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`)
+
+var releaseLease = radix.NewEvalScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call("DEL", KEYS[1])
+`)
+
+// RedisShardCoordinator leases shards in Redis
+type RedisShardCoordinator struct {
+	Redis  redis.RedisActor
+	Prefix string
+
+	// InstanceID identifies the process holding a lease; defaults to a random ID. A process that
+	// restarts with the same ID acquires its leases again without waiting for them to expire.
+	InstanceID string
+	// LeaseTTL defaults to DefaultLeaseTTL
+	LeaseTTL time.Duration
+
+	once sync.Once
+}
+
+// Acquire attempts to lease the given shard, returning whether this process holds the lease
+func (c *RedisShardCoordinator) Acquire(ctx context.Context, shardID int) (bool, error) {
+	var n int
+	err := c.Redis.Do(ctx, acquireLease.Cmd(&n, []string{c.leaseKey(shardID)}, c.owner(), c.ttl()))
+	return n == 1, err
+}
+
+// Renew extends the lease on the given shard, returning false if this process no longer holds it
+func (c *RedisShardCoordinator) Renew(ctx context.Context, shardID int) (bool, error) {
+	var n int
+	err := c.Redis.Do(ctx, renewLease.Cmd(&n, []string{c.leaseKey(shardID)}, c.owner(), c.ttl()))
+	return n == 1, err
+}
+
+// Release gives up the lease on the given shard, if this process holds it
+func (c *RedisShardCoordinator) Release(ctx context.Context, shardID int) error {
+	return c.Redis.Do(ctx, releaseLease.Cmd(nil, []string{c.leaseKey(shardID)}, c.owner()))
+}
+
+// TTL returns how long a lease lasts unless it's renewed
+func (c *RedisShardCoordinator) TTL() time.Duration {
+	if c.LeaseTTL == 0 {
+		return DefaultLeaseTTL
+	}
+	return c.LeaseTTL
+}
+
+func (c *RedisShardCoordinator) owner() string {
+	c.once.Do(func() {
+		if c.InstanceID == "" {
+			c.InstanceID = newNonce()
+		}
+	})
+	return c.InstanceID
+}
+
+func (c *RedisShardCoordinator) ttl() string {
+	return strconv.FormatInt(c.TTL().Milliseconds(), 10)
+}
+
+func (c *RedisShardCoordinator) leaseKey(shardID int) string {
+	return c.Prefix + strconv.Itoa(shardID) + "lease"
+}
@@ -1,15 +1,20 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"runtime"
+	"sync/atomic"
 	"time"
 
+	"github.com/spec-tacles/gateway/compression"
 	"github.com/spec-tacles/go/types"
 )
 
-// Retryer calculates the wait time between retries
+// Retryer calculates the wait time between retries. NextTimeout returns an error to give up, after
+// which the shard is dead. The default retryer doubles the timeout up to 5 minutes and never gives
+// up, so that shards outlive Discord outages.
 type Retryer interface {
 	FirstTimeout() time.Duration
 	NextTimeout(time.Duration, int) (time.Duration, error)
@@ -22,12 +27,40 @@ type ShardOptions struct {
 	Retryer  Retryer
 	Store    ShardStore
 
-	OnPacket func(*types.ReceivePacket)
+	// Compression is the transport compression type; defaults to compression.Default()
+	Compression string
+	// CompressSent compresses sent packets with the transport compression as well. Discord only
+	// compresses packets it sends, so this is only useful with proxies that accept compressed
+	// packets.
+	CompressSent bool
+	// Encoding is the payload encoding, EncodingJSON or EncodingETF; defaults to EncodingJSON.
+	// The data of ETF packets is converted to JSON when received, unless RawETF is set.
+	Encoding string
+	// RawETF leaves the data of ETF packets encoded as ETF, so that OnPacket sees ETF data. This
+	// skips converting every packet to JSON when consumers can read ETF themselves.
+	RawETF bool
+
+	// SessionTTL is how long after it was last stored a session is resumed; older sessions have
+	// most likely been discarded by Discord, so the shard identifies instead. Sessions don't
+	// expire unless it's set; Discord discards them after a few minutes, so 15m is reasonable.
+	SessionTTL time.Duration
+
+	// SuppressDuplicates prevents OnPacket from being called for dispatches that were already
+	// received in the session, such as those replayed after resuming
+	SuppressDuplicates bool
+
+	OnPacket      func(*types.ReceivePacket)
+	OnStateChange func(old, new ShardState)
 
 	Logger   *log.Logger
 	LogLevel int
 
 	IdentifyLimiter Limiter
+
+	// presence is the presence the shard identifies with, shared by the shards of a manager
+	presence *atomic.Pointer[types.StatusUpdate]
+	// leased, if set, reports whether this process still holds the shard's lease
+	leased func(context.Context) bool
 }
 
 func (opts *ShardOptions) init() {
@@ -40,6 +73,14 @@ func (opts *ShardOptions) init() {
 	}
 	opts.Logger = ChildLogger(opts.Logger, fmt.Sprintf("[shard %d]", opts.Identify.Shard[0]))
 
+	if opts.Compression == "" {
+		opts.Compression = compression.Default()
+	}
+
+	if opts.Encoding == "" {
+		opts.Encoding = EncodingJSON
+	}
+
 	if opts.Retryer == nil {
 		opts.Retryer = defaultRetryer{}
 	}
@@ -58,6 +99,11 @@ func (opts *ShardOptions) init() {
 		}
 	}
 
+	if opts.presence == nil {
+		opts.presence = new(atomic.Pointer[types.StatusUpdate])
+		opts.presence.Store(opts.Identify.Presence)
+	}
+
 	if opts.Store == nil {
 		opts.Store = NewLocalShardStore()
 	}
@@ -72,15 +118,10 @@ func (opts ShardOptions) clone() *ShardOptions {
 
 type defaultRetryer struct{}
 
-const maxRetries = 5
 const maxRetry = time.Minute * 5
 
 func (defaultRetryer) FirstTimeout() time.Duration { return time.Second }
 func (defaultRetryer) NextTimeout(timeout time.Duration, retries int) (time.Duration, error) {
-	if retries > maxRetries {
-		return 0, ErrMaxRetriesExceeded
-	}
-
 	timeout *= 2
 
 	if timeout > maxRetry {
@@ -0,0 +1,55 @@
+package gateway
+
+// ShardState represents the state of a shard's connection to the gateway
+type ShardState int32
+
+// Shard states
+const (
+	ShardStateStopped ShardState = iota
+	ShardStateConnecting
+	ShardStateIdentifying
+	ShardStateResuming
+	ShardStateReady
+	ShardStateReconnecting
+	ShardStateDead
+)
+
+var shardStateNames = map[ShardState]string{
+	ShardStateStopped:      "stopped",
+	ShardStateConnecting:   "connecting",
+	ShardStateIdentifying:  "identifying",
+	ShardStateResuming:     "resuming",
+	ShardStateReady:        "ready",
+	ShardStateReconnecting: "reconnecting",
+	ShardStateDead:         "dead",
+}
+
+func (s ShardState) String() string {
+	if name, ok := shardStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s ShardState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Status returns the current state of this shard
+func (s *Shard) Status() ShardState {
+	return ShardState(s.state.Load())
+}
+
+// setState transitions this shard to the given state, notifying OnStateChange if it changed
+func (s *Shard) setState(state ShardState) {
+	old := ShardState(s.state.Swap(int32(state)))
+	if old == state {
+		return
+	}
+
+	s.log(LogLevelDebug, "state %s -> %s", old, state)
+	if s.opts.OnStateChange != nil {
+		s.opts.OnStateChange(old, state)
+	}
+}
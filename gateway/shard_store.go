@@ -4,6 +4,7 @@ import (
 	"context"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mediocregopher/radix/v4"
 	"github.com/spec-tacles/go/broker/redis"
@@ -11,6 +12,20 @@ import (
 
 // ShardStore represents a generic structure that can store information about a shard
 type ShardStore interface {
+	BasicShardStore
+	GetResumeURL(ctx context.Context, shardID uint) (url string, err error)
+	SetResumeURL(ctx context.Context, shardID uint, url string) error
+
+	// GetUpdatedAt gets when the session of the given shard was last stored, or the zero time if
+	// that isn't known
+	GetUpdatedAt(ctx context.Context, shardID uint) (time.Time, error)
+	// ClearSession forgets the session of the given shard, including its sequence and resume URL
+	ClearSession(ctx context.Context, shardID uint) error
+}
+
+// BasicShardStore stores the sequence and session of a shard, but not where to resume it or when
+// it was stored. Use NewLegacyShardStore to use one as a ShardStore.
+type BasicShardStore interface {
 	GetSeq(ctx context.Context, shardID uint) (seq uint, err error)
 	SetSeq(ctx context.Context, shardID uint, seq uint) error
 	GetSession(ctx context.Context, shardID uint) (session string, err error)
@@ -19,20 +34,28 @@ type ShardStore interface {
 
 // LocalShardStore stores shard information in memory
 type LocalShardStore struct {
-	seqMux     *sync.RWMutex
-	sessionMux *sync.RWMutex
+	seqMux       *sync.RWMutex
+	sessionMux   *sync.RWMutex
+	resumeURLMux *sync.RWMutex
+	updatedMux   *sync.RWMutex
 
-	seqs     map[uint]uint
-	sessions map[uint]string
+	seqs       map[uint]uint
+	sessions   map[uint]string
+	resumeURLs map[uint]string
+	updated    map[uint]time.Time
 }
 
 // NewLocalShardStore initializes a local shard store with the necessary state
 func NewLocalShardStore() *LocalShardStore {
 	return &LocalShardStore{
-		seqMux:     &sync.RWMutex{},
-		sessionMux: &sync.RWMutex{},
-		seqs:       make(map[uint]uint),
-		sessions:   make(map[uint]string),
+		seqMux:       &sync.RWMutex{},
+		sessionMux:   &sync.RWMutex{},
+		resumeURLMux: &sync.RWMutex{},
+		updatedMux:   &sync.RWMutex{},
+		seqs:         make(map[uint]uint),
+		sessions:     make(map[uint]string),
+		resumeURLs:   make(map[uint]string),
+		updated:      make(map[uint]time.Time),
 	}
 }
 
@@ -53,6 +76,8 @@ func (s *LocalShardStore) SetSeq(ctx context.Context, shardID uint, seq uint) er
 	if seq > s.seqs[shardID] {
 		s.seqs[shardID] = seq
 	}
+
+	s.touch(shardID)
 	return nil
 }
 
@@ -71,20 +96,88 @@ func (s *LocalShardStore) SetSession(ctx context.Context, shardID uint, session
 	defer s.sessionMux.Unlock()
 
 	s.sessions[shardID] = session
+
+	s.touch(shardID)
+	return nil
+}
+
+// GetResumeURL gets the URL to resume the session of the given shard with
+func (s *LocalShardStore) GetResumeURL(ctx context.Context, shardID uint) (url string, err error) {
+	s.resumeURLMux.RLock()
+	defer s.resumeURLMux.RUnlock()
+
+	url = s.resumeURLs[shardID]
+	return
+}
+
+// SetResumeURL sets the URL to resume the session of the given shard with
+func (s *LocalShardStore) SetResumeURL(ctx context.Context, shardID uint, url string) error {
+	s.resumeURLMux.Lock()
+	defer s.resumeURLMux.Unlock()
+
+	s.resumeURLs[shardID] = url
+	return nil
+}
+
+// GetUpdatedAt gets when the session of the given shard was last stored
+func (s *LocalShardStore) GetUpdatedAt(ctx context.Context, shardID uint) (updated time.Time, err error) {
+	s.updatedMux.RLock()
+	defer s.updatedMux.RUnlock()
+
+	updated = s.updated[shardID]
+	return
+}
+
+func (s *LocalShardStore) touch(shardID uint) {
+	s.updatedMux.Lock()
+	defer s.updatedMux.Unlock()
+
+	s.updated[shardID] = time.Now()
+}
+
+// ClearSession forgets the session, sequence and resume URL of the given shard
+func (s *LocalShardStore) ClearSession(ctx context.Context, shardID uint) error {
+	s.seqMux.Lock()
+	delete(s.seqs, shardID)
+	s.seqMux.Unlock()
+
+	s.sessionMux.Lock()
+	delete(s.sessions, shardID)
+	s.sessionMux.Unlock()
+
+	s.resumeURLMux.Lock()
+	delete(s.resumeURLs, shardID)
+	s.resumeURLMux.Unlock()
+
+	s.updatedMux.Lock()
+	delete(s.updated, shardID)
+	s.updatedMux.Unlock()
 	return nil
 }
 
+// setMax sets a key to the greater of its value and ARGV[1], refreshing its expiry to ARGV[2]
+// milliseconds unless that's 0
 var setMax = radix.NewEvalScript(`
-local current = tonumber(redis.call("GET", KEYS[1]))
-if current == nil then current = 0 end
-if tonumber(ARGV[1]) > current then return redis.call("SET", KEYS[1], ARGV[1]) end
+local current = redis.call("GET", KEYS[1])
+local greater = not current or tonumber(ARGV[1]) > tonumber(current)
+if greater then current = ARGV[1] end
+if ARGV[2] ~= "0" then return redis.call("SET", KEYS[1], current, "PX", ARGV[2]) end
+if greater then return redis.call("SET", KEYS[1], current) end
 return nil
 `)
 
+// redisTouchInterval is the longest time between updates of a shard's session timestamp in Redis
+const redisTouchInterval = 10 * time.Second
+
 // RedisShardStore stores information about shards in Redis
 type RedisShardStore struct {
 	Redis  redis.RedisActor
 	Prefix string
+
+	// SessionTTL, if set, is how long the session of a shard is kept after it was last stored
+	SessionTTL time.Duration
+
+	touched sync.Map
 }
 
 // GetSeq gets the current sequence of the given shard
@@ -95,7 +188,12 @@ func (s *RedisShardStore) GetSeq(ctx context.Context, shardID uint) (seq uint, e
 
 // SetSeq sets the current sequence of the given shard, ignoring values that are less than the current value
 func (s *RedisShardStore) SetSeq(ctx context.Context, shardID uint, seq uint) error {
-	return s.Redis.Do(ctx, setMax.Cmd(nil, []string{s.shardKey(shardID) + "seq"}, strconv.FormatUint(uint64(seq), 10)))
+	err := s.Redis.Do(ctx, setMax.Cmd(nil, []string{s.shardKey(shardID) + "seq"}, strconv.FormatUint(uint64(seq), 10), s.ttl()))
+	if err != nil {
+		return err
+	}
+
+	return s.touch(ctx, shardID, false)
 }
 
 // GetSession gets the session identifier for the given shard
@@ -106,9 +204,170 @@ func (s *RedisShardStore) GetSession(ctx context.Context, shardID uint) (session
 
 // SetSession sets the session identifier for the given shard
 func (s *RedisShardStore) SetSession(ctx context.Context, shardID uint, session string) error {
-	return s.Redis.Do(ctx, radix.Cmd(nil, "SET", s.shardKey(shardID)+"session", session))
+	err := s.Redis.Do(ctx, radix.Cmd(nil, "SET", s.expiring(s.shardKey(shardID)+"session", session)...))
+	if err != nil {
+		return err
+	}
+
+	return s.touch(ctx, shardID, true)
+}
+
+// GetResumeURL gets the URL to resume the session of the given shard with
+func (s *RedisShardStore) GetResumeURL(ctx context.Context, shardID uint) (url string, err error) {
+	err = s.Redis.Do(ctx, radix.Cmd(&url, "GET", s.shardKey(shardID)+"resume_url"))
+	return
+}
+
+// SetResumeURL sets the URL to resume the session of the given shard with
+func (s *RedisShardStore) SetResumeURL(ctx context.Context, shardID uint, url string) error {
+	return s.Redis.Do(ctx, radix.Cmd(nil, "SET", s.expiring(s.shardKey(shardID)+"resume_url", url)...))
+}
+
+// GetUpdatedAt gets when the session of the given shard was last stored, to within a few seconds
+func (s *RedisShardStore) GetUpdatedAt(ctx context.Context, shardID uint) (time.Time, error) {
+	var millis int64
+	err := s.Redis.Do(ctx, radix.Cmd(&millis, "GET", s.shardKey(shardID)+"updated_at"))
+	if err != nil || millis == 0 {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// ClearSession forgets the session, sequence and resume URL of the given shard
+func (s *RedisShardStore) ClearSession(ctx context.Context, shardID uint) error {
+	s.touched.Delete(shardID)
+
+	key := s.shardKey(shardID)
+	return s.Redis.Do(ctx, radix.Cmd(nil, "DEL", key+"seq", key+"session", key+"resume_url", key+"updated_at"))
+}
+
+// touch stores the time the session of the given shard was updated and keeps its keys from
+// expiring. Unless forced, it does so at most once per touch interval.
+func (s *RedisShardStore) touch(ctx context.Context, shardID uint, force bool) error {
+	now := time.Now()
+	if last, ok := s.touched.Load(shardID); ok && !force && now.Sub(last.(time.Time)) < redisTouchInterval {
+		return nil
+	}
+	s.touched.Store(shardID, now)
+
+	key := s.shardKey(shardID)
+	err := s.Redis.Do(ctx, radix.Cmd(nil, "SET", s.expiring(key+"updated_at", strconv.FormatInt(now.UnixMilli(), 10))...))
+	if err != nil || s.SessionTTL == 0 {
+		return err
+	}
+
+	for _, k := range []string{key + "session", key + "resume_url"} {
+		if err = s.Redis.Do(ctx, radix.Cmd(nil, "PEXPIRE", k, s.ttl())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiring returns the arguments of a SET command that expires after the session TTL, if any
+func (s *RedisShardStore) expiring(key, value string) []string {
+	if s.SessionTTL == 0 {
+		return []string{key, value}
+	}
+	return []string{key, value, "PX", s.ttl()}
+}
+
+// ttl returns the session TTL in milliseconds
+func (s *RedisShardStore) ttl() string {
+	return strconv.FormatInt(s.SessionTTL.Milliseconds(), 10)
 }
 
 func (s *RedisShardStore) shardKey(shardID uint) string {
 	return s.Prefix + strconv.FormatUint(uint64(shardID), 10)
 }
+
+// sessionClearer is implemented by basic shard stores that can forget sessions
+type sessionClearer interface {
+	ClearSession(ctx context.Context, shardID uint) error
+}
+
+// LegacyShardStore adapts a BasicShardStore to a ShardStore, keeping resume URLs and when sessions
+// were stored in memory
+type LegacyShardStore struct {
+	BasicShardStore
+
+	resumeURLMux *sync.RWMutex
+	updatedMux   *sync.RWMutex
+
+	resumeURLs map[uint]string
+	updated    map[uint]time.Time
+}
+
+// NewLegacyShardStore wraps a shard store that doesn't store resume URLs or session timestamps
+func NewLegacyShardStore(store BasicShardStore) *LegacyShardStore {
+	return &LegacyShardStore{
+		BasicShardStore: store,
+		resumeURLMux:    &sync.RWMutex{},
+		updatedMux:      &sync.RWMutex{},
+		resumeURLs:      make(map[uint]string),
+		updated:         make(map[uint]time.Time),
+	}
+}
+
+// SetSeq sets the current sequence of the given shard in the wrapped store
+func (s *LegacyShardStore) SetSeq(ctx context.Context, shardID uint, seq uint) error {
+	s.touch(shardID)
+	return s.BasicShardStore.SetSeq(ctx, shardID, seq)
+}
+
+// SetSession sets the session identifier for the given shard in the wrapped store
+func (s *LegacyShardStore) SetSession(ctx context.Context, shardID uint, session string) error {
+	s.touch(shardID)
+	return s.BasicShardStore.SetSession(ctx, shardID, session)
+}
+
+// GetResumeURL gets the URL to resume the session of the given shard with
+func (s *LegacyShardStore) GetResumeURL(ctx context.Context, shardID uint) (url string, err error) {
+	s.resumeURLMux.RLock()
+	defer s.resumeURLMux.RUnlock()
+
+	url = s.resumeURLs[shardID]
+	return
+}
+
+// SetResumeURL sets the URL to resume the session of the given shard with
+func (s *LegacyShardStore) SetResumeURL(ctx context.Context, shardID uint, url string) error {
+	s.resumeURLMux.Lock()
+	defer s.resumeURLMux.Unlock()
+
+	s.resumeURLs[shardID] = url
+	return nil
+}
+
+// GetUpdatedAt gets when the session of the given shard was last stored by this process
+func (s *LegacyShardStore) GetUpdatedAt(ctx context.Context, shardID uint) (updated time.Time, err error) {
+	s.updatedMux.RLock()
+	defer s.updatedMux.RUnlock()
+
+	updated = s.updated[shardID]
+	return
+}
+
+func (s *LegacyShardStore) touch(shardID uint) {
+	s.updatedMux.Lock()
+	defer s.updatedMux.Unlock()
+
+	s.updated[shardID] = time.Now()
+}
+
+// ClearSession forgets the session of the given shard. Unless the wrapped store can clear
+// sessions itself, only the session identifier is cleared; its sequence is kept.
+func (s *LegacyShardStore) ClearSession(ctx context.Context, shardID uint) error {
+	s.resumeURLMux.Lock()
+	delete(s.resumeURLs, shardID)
+	s.resumeURLMux.Unlock()
+
+	s.updatedMux.Lock()
+	delete(s.updated, shardID)
+	s.updatedMux.Unlock()
+
+	if c, ok := s.BasicShardStore.(sessionClearer); ok {
+		return c.ClearSession(ctx, shardID)
+	}
+	return s.BasicShardStore.SetSession(ctx, shardID, "")
+}
@@ -0,0 +1,232 @@
+package gateway
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix/v4"
+)
+
+// checkSession checks the session state stored for shard 0
+func checkSession(t *testing.T, store ShardStore, seq uint, session, resumeURL string, updated bool) {
+	t.Helper()
+	ctx := context.Background()
+
+	if got, err := store.GetSeq(ctx, 0); err != nil || got != seq {
+		t.Errorf("GetSeq() = %d, %v, want %d", got, err, seq)
+	}
+	if got, err := store.GetSession(ctx, 0); err != nil || got != session {
+		t.Errorf("GetSession() = %q, %v, want %q", got, err, session)
+	}
+	if got, err := store.GetResumeURL(ctx, 0); err != nil || got != resumeURL {
+		t.Errorf("GetResumeURL() = %q, %v, want %q", got, err, resumeURL)
+	}
+
+	got, err := store.GetUpdatedAt(ctx, 0)
+	if err != nil {
+		t.Errorf("GetUpdatedAt() returned %v", err)
+	}
+	if recent := time.Since(got) < time.Minute; recent != updated || (!updated && !got.IsZero()) {
+		t.Errorf("GetUpdatedAt() = %s, want updated %t", got, updated)
+	}
+}
+
+// storeSession stores a session for shard 0
+func storeSession(t *testing.T, store ShardStore, seqs ...uint) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, seq := range seqs {
+		if err := store.SetSeq(ctx, 0, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetSession(ctx, 0, "session"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetResumeURL(ctx, 0, "wss://resume"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalShardStore(t *testing.T) {
+	store := NewLocalShardStore()
+	checkSession(t, store, 0, "", "", false)
+
+	storeSession(t, store, 5, 7, 6)
+	checkSession(t, store, 7, "session", "wss://resume", true)
+
+	if err := store.ClearSession(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSession(t, store, 0, "", "", false)
+}
+
+// basicShardStore hides every method of a shard store but those of BasicShardStore
+type basicShardStore struct {
+	BasicShardStore
+}
+
+func TestLegacyShardStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		store BasicShardStore
+		seq   uint
+	}{
+		{"basic store", basicShardStore{NewLocalShardStore()}, 7},
+		{"store that clears sessions", NewLocalShardStore(), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewLegacyShardStore(tt.store)
+			checkSession(t, store, 0, "", "", false)
+
+			storeSession(t, store, 5, 7, 6)
+			checkSession(t, store, 7, "session", "wss://resume", true)
+
+			if err := store.ClearSession(context.Background(), 0); err != nil {
+				t.Fatal(err)
+			}
+			checkSession(t, store, tt.seq, "", "", false)
+		})
+	}
+}
+
+// fakeRedis serves the commands used by RedisShardStore from memory, recording the expiry of
+// keys in milliseconds without expiring them
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]string
+	cmds   []string
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: make(map[string]string), ttls: make(map[string]string)}
+}
+
+func (r *fakeRedis) Do(ctx context.Context, a radix.Action) error {
+	return a.Perform(ctx, radix.NewStubConn("", "", r.handle))
+}
+
+func (r *fakeRedis) handle(ctx context.Context, args []string) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cmds = append(r.cmds, args[0]+" "+args[1])
+	switch args[0] {
+	case "GET":
+		if v, ok := r.values[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		r.set(args[1], args[2], args[3:])
+		return "OK"
+	case "DEL":
+		for _, k := range args[1:] {
+			delete(r.values, k)
+			delete(r.ttls, k)
+		}
+		return len(args) - 1
+	case "PEXPIRE":
+		if _, ok := r.values[args[1]]; !ok {
+			return 0
+		}
+		r.ttls[args[1]] = args[2]
+		return 1
+	case "EVALSHA":
+		// setMax, with its key and arguments following the number of keys
+		key, value, ttl := args[3], args[4], args[5]
+		current, ok := r.values[key]
+		greater := !ok || parseUint(value) > parseUint(current)
+		if greater {
+			current = value
+		}
+		if ttl != "0" {
+			r.set(key, current, []string{"PX", ttl})
+			return "OK"
+		}
+		if greater {
+			r.set(key, current, nil)
+			return "OK"
+		}
+		return nil
+	}
+	return nil
+}
+
+// set sets a key, with the expiry given by a PX option if any
+func (r *fakeRedis) set(key, value string, opts []string) {
+	r.values[key] = value
+	delete(r.ttls, key)
+	if len(opts) == 2 && opts[0] == "PX" {
+		r.ttls[key] = opts[1]
+	}
+}
+
+// count returns how many times the given command and key were sent
+func (r *fakeRedis) count(cmd string) (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return
+}
+
+func parseUint(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+func TestRedisShardStore(t *testing.T) {
+	keys := []string{"gateway0seq", "gateway0session", "gateway0resume_url", "gateway0updated_at"}
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want string
+	}{
+		{"no expiry", 0, ""},
+		{"expiry", 15 * time.Minute, "900000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRedis()
+			store := &RedisShardStore{Redis: r, Prefix: "gateway", SessionTTL: tt.ttl}
+			checkSession(t, store, 0, "", "", false)
+
+			storeSession(t, store, 5, 7, 6)
+			checkSession(t, store, 7, "session", "wss://resume", true)
+
+			for _, k := range keys {
+				if got := r.ttls[k]; got != tt.want {
+					t.Errorf("%s expires in %q ms, want %q", k, got, tt.want)
+				}
+			}
+
+			// the timestamp is stored by the first sequence and again by the session, which
+			// forces it, but not by the sequences in between
+			if n := r.count("SET gateway0updated_at"); n != 2 {
+				t.Errorf("stored the timestamp %d times, want 2", n)
+			}
+
+			if err := store.ClearSession(context.Background(), 0); err != nil {
+				t.Fatal(err)
+			}
+			checkSession(t, store, 0, "", "", false)
+			if len(r.values) != 0 {
+				t.Errorf("%v was left stored after clearing the session", r.values)
+			}
+		})
+	}
+}
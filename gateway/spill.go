@@ -0,0 +1,376 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spec-tacles/gateway/stats"
+)
+
+// spillSegmentSize is the size at which spill segments are rotated
+const spillSegmentSize = 16 << 20
+
+// spillHeaderSize is the size of the magic number, length and checksum preceding each spilled event
+const spillHeaderSize = 12
+
+// spillMagic marks the start of each spilled event, so that corrupt events can be skipped without
+// checksumming every offset after them
+const spillMagic = 0x53504c31
+
+// spill is a write-ahead log of events that couldn't be published. Events are appended to segment
+// files in a directory and read back in order; segments are deleted once they have been read.
+// Events are replayed at least once: if the gateway exits while replaying a segment, the events
+// that were already replayed from it are replayed again. Segments are synced to disk when they're
+// rotated or closed, and corrupt events are skipped.
+type spill struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	segments []uint64
+	size     int64
+	wake     chan struct{}
+
+	w     *os.File
+	wsize int64
+
+	r       *os.File
+	roff    int64
+	pending int64
+}
+
+// newSpill opens a spill directory, replaying any segments left in it
+func newSpill(dir string, maxSize int64) (*spill, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spill{
+		dir:     dir,
+		maxSize: maxSize,
+		wake:    make(chan struct{}, 1),
+	}
+
+	for _, e := range entries {
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".wal"), 10, 64)
+		if err != nil || e.IsDir() || !strings.HasSuffix(e.Name(), ".wal") {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		s.segments = append(s.segments, id)
+		s.size += info.Size()
+	}
+
+	slices.Sort(s.segments)
+	stats.SpillSize.Set(float64(s.size))
+	return s, nil
+}
+
+// path returns the path of the segment with the given ID
+func (s *spill) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.wal", id))
+}
+
+// write appends an event to the log. Unless force is set, the event is only appended if the log
+// has events that haven't been replayed yet, so that events are published in order. It returns
+// whether the event was handled by the log.
+func (s *spill) write(p *publication, force bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !force && len(s.segments) == 0 {
+		return false, nil
+	}
+
+	payload := make([]byte, spillHeaderSize, spillHeaderSize+3*binary.MaxVarintLen64+len(p.event)+len(p.key)+len(p.data))
+	payload = binary.AppendUvarint(payload, uint64(len(p.event)))
+	payload = append(payload, p.event...)
+	payload = binary.AppendUvarint(payload, uint64(len(p.key)))
+	payload = append(payload, p.key...)
+	payload = binary.AppendUvarint(payload, uint64(p.partitions))
+	payload = append(payload, p.data...)
+
+	n := int64(len(payload))
+	if s.size+n > s.maxSize {
+		return true, ErrSpillFull
+	}
+
+	binary.BigEndian.PutUint32(payload, spillMagic)
+	binary.BigEndian.PutUint32(payload[4:], uint32(n-spillHeaderSize))
+	binary.BigEndian.PutUint32(payload[8:], crc32.ChecksumIEEE(payload[spillHeaderSize:]))
+
+	if s.w == nil || s.wsize+n > spillSegmentSize && s.wsize > 0 {
+		if err := s.rotate(); err != nil {
+			return true, err
+		}
+	}
+
+	if _, err := s.w.Write(payload); err != nil {
+		return true, err
+	}
+
+	s.wsize += n
+	s.size += n
+	stats.SpillSize.Set(float64(s.size))
+	stats.EventsSpilled.Inc()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// rotate starts a new segment for writing; the lock must be held
+func (s *spill) rotate() error {
+	if err := s.closeWriter(); err != nil {
+		return err
+	}
+
+	id := uint64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+
+	f, err := os.OpenFile(s.path(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s.w, s.wsize = f, 0
+	s.segments = append(s.segments, id)
+	return nil
+}
+
+// closeWriter syncs and closes the segment being written, if any; the lock must be held
+func (s *spill) closeWriter() error {
+	if s.w == nil {
+		return nil
+	}
+
+	err := s.w.Sync()
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	s.w = nil
+	return err
+}
+
+// close syncs and closes the segment being written. Events written afterwards start a new segment.
+func (s *spill) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeWriter()
+}
+
+// next returns the oldest event that hasn't been replayed, waiting until there is one. The event
+// must be committed before the next one is read.
+func (s *spill) next() (*publication, error) {
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+
+		p, err := s.read()
+		s.mu.Unlock()
+
+		if p != nil || err != nil {
+			return p, err
+		}
+	}
+}
+
+// read reads the event at the current position, removing the oldest segment if it has been read
+// completely. It returns no event if the segment was removed. Corrupt events, such as one left
+// truncated at the end of a segment by a torn write, are skipped up to the next valid event,
+// returning ErrSpillCorrupt. The lock must be held.
+func (s *spill) read() (*publication, error) {
+	if s.r == nil {
+		f, err := os.Open(s.path(s.segments[0]))
+		if err != nil {
+			return nil, err
+		}
+		s.r, s.roff = f, 0
+	}
+
+	p, n, err := s.record()
+	switch {
+	case err == nil:
+		s.pending = n
+		return p, nil
+	case errors.Is(err, io.EOF):
+		return nil, s.removeSegment(err)
+	case !errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, err
+	}
+
+	off, err := s.resync()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("%w: skipped %d bytes at offset %d of %s", ErrSpillCorrupt, off-s.roff, s.roff, s.r.Name())
+	s.roff = off
+	return nil, err
+}
+
+// record reads the event at the current position and its size. It returns io.EOF at the end of the
+// segment and io.ErrUnexpectedEOF if the event is corrupt. The lock must be held.
+func (s *spill) record() (*publication, int64, error) {
+	var header [spillHeaderSize]byte
+	read, err := s.r.ReadAt(header[:], s.roff)
+	switch {
+	case read == 0 && errors.Is(err, io.EOF):
+		return nil, 0, io.EOF
+	case errors.Is(err, io.EOF):
+		return nil, 0, io.ErrUnexpectedEOF
+	case err != nil:
+		return nil, 0, err
+	}
+
+	n := int64(binary.BigEndian.Uint32(header[4:]))
+	if binary.BigEndian.Uint32(header[:]) != spillMagic || n > s.maxSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, spillHeaderSize+n)
+	copy(b, header[:])
+	if _, err = s.r.ReadAt(b[spillHeaderSize:], s.roff+spillHeaderSize); errors.Is(err, io.EOF) {
+		return nil, 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	p := decodeSpilled(b)
+	if p == nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return p, int64(len(b)), nil
+}
+
+// resync returns the position of the next valid event after a corrupt one at the current
+// position, or the end of the segment if there isn't one. Only positions starting with the magic
+// number and a length within the segment are checksummed. The lock must be held.
+func (s *spill) resync() (int64, error) {
+	info, err := s.r.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	b := make([]byte, max(info.Size()-s.roff, 0))
+	if _, err = s.r.ReadAt(b, s.roff); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	magic := binary.BigEndian.AppendUint32(nil, spillMagic)
+	for i := 1; i+spillHeaderSize <= len(b); i++ {
+		j := bytes.Index(b[i:], magic)
+		if j < 0 {
+			break
+		}
+
+		i += j
+		if i+spillHeaderSize > len(b) {
+			break
+		}
+
+		n := int(binary.BigEndian.Uint32(b[i+4:]))
+		if n <= len(b)-i-spillHeaderSize && decodeSpilled(b[i:i+spillHeaderSize+n]) != nil {
+			return s.roff + int64(i), nil
+		}
+	}
+	return s.roff + int64(len(b)), nil
+}
+
+// decodeSpilled decodes a spilled event with its header, returning nil if it's corrupt
+func decodeSpilled(b []byte) *publication {
+	payload := b[spillHeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(b[8:]) {
+		return nil
+	}
+
+	p := &publication{}
+	ok := true
+	field := func() []byte {
+		n, size := binary.Uvarint(payload)
+		if size <= 0 || uint64(len(payload)-size) < n {
+			ok = false
+			return nil
+		}
+
+		b := payload[size : size+int(n)]
+		payload = payload[size+int(n):]
+		return b
+	}
+
+	p.event = string(field())
+	p.key = string(field())
+	partitions, size := binary.Uvarint(payload)
+	if !ok || size <= 0 {
+		return nil
+	}
+
+	p.partitions = int(partitions)
+	p.data = payload[size:]
+	return p
+}
+
+// removeSegment removes the oldest segment once it has been read to the end. The end of the
+// segment being written is only reached once every event has been replayed. The lock must be
+// held.
+func (s *spill) removeSegment(err error) error {
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	if len(s.segments) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+
+	s.r.Close()
+	s.r = nil
+
+	path := s.path(s.segments[0])
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	s.segments = s.segments[1:]
+	stats.SpillSize.Set(float64(s.size))
+
+	return os.Remove(path)
+}
+
+// commit advances past the event returned by next once it has been published
+func (s *spill) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roff += s.pending
+	s.pending = 0
+	stats.EventsReplayed.Inc()
+}
@@ -0,0 +1,211 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+// openSpill opens a spill buffer in dir, failing the test on error
+func openSpill(t *testing.T, dir string) *spill {
+	t.Helper()
+
+	s, err := newSpill(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unable to open spill: %s", err)
+	}
+	return s
+}
+
+// spillEvents writes events to a spill buffer, returning their offsets in the segment
+func spillEvents(t *testing.T, s *spill, events ...string) []int64 {
+	t.Helper()
+
+	offsets := make([]int64, len(events))
+	for i, event := range events {
+		offsets[i] = s.wsize
+		p := &publication{event: event, key: event, partitions: i, data: []byte(`{"event":"` + event + `"}`)}
+		if _, err := s.write(p, true); err != nil {
+			t.Fatalf("unable to spill %s: %s", event, err)
+		}
+	}
+	return offsets
+}
+
+// replayEvents reads n events from a spill buffer, committing each. Corrupt events are returned
+// as "!".
+func replayEvents(t *testing.T, s *spill, n int) []string {
+	t.Helper()
+
+	var events []string
+	for len(events) < n {
+		p, err := s.next()
+		if errors.Is(err, ErrSpillCorrupt) {
+			events = append(events, "!")
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unable to read spilled event: %s", err)
+		}
+
+		if string(p.data) != `{"event":"`+p.event+`"}` || p.key != p.event {
+			t.Errorf("read spilled event %+v", p)
+		}
+		events = append(events, p.event)
+		s.commit()
+	}
+	return events
+}
+
+// checkSpillEmpty checks that a spill buffer removes its segments once it's been read
+func checkSpillEmpty(t *testing.T, s *spill) {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, err := s.read(); p != nil || err != nil {
+		t.Fatalf("read %+v (%v) from the end of the spill", p, err)
+	}
+	if len(s.segments) != 0 || s.size != 0 {
+		t.Errorf("spill has %d segments of %d bytes left", len(s.segments), s.size)
+	}
+}
+
+func TestSpillReplay(t *testing.T) {
+	s := openSpill(t, t.TempDir())
+	spillEvents(t, s, "a", "b", "c")
+
+	if got := replayEvents(t, s, 2); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("replayed %v", got)
+	}
+
+	if ok, err := s.write(&publication{event: "d", key: "d", data: []byte(`{"event":"d"}`)}, false); !ok || err != nil {
+		t.Fatalf("events weren't spilled while the spill had events (%v)", err)
+	}
+
+	if got := replayEvents(t, s, 2); !slices.Equal(got, []string{"c", "d"}) {
+		t.Errorf("replayed %v", got)
+	}
+	checkSpillEmpty(t, s)
+
+	if ok, _ := s.write(&publication{event: "e"}, false); ok {
+		t.Error("events were spilled while the spill was empty")
+	}
+}
+
+func TestSpillRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpill(t, dir)
+	spillEvents(t, s, "a", "b", "c")
+	replayEvents(t, s, 1)
+	if err := s.close(); err != nil {
+		t.Fatalf("unable to close spill: %s", err)
+	}
+
+	// events replayed from a segment that wasn't finished are replayed again
+	s = openSpill(t, dir)
+	spillEvents(t, s, "d", "e")
+	if len(s.segments) != 2 {
+		t.Errorf("spill has %d segments, want 2", len(s.segments))
+	}
+
+	want := []string{"a", "b", "c", "d", "e"}
+	if got := replayEvents(t, s, len(want)); !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	checkSpillEmpty(t, s)
+}
+
+func TestSpillCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte, offsets []int64) []byte
+		want    []string
+	}{
+		{
+			"data",
+			func(b []byte, offsets []int64) []byte {
+				b[offsets[2]-2] ^= 0xff
+				return b
+			},
+			[]string{"a", "!", "c", "d"},
+		},
+		{
+			"magic",
+			func(b []byte, offsets []int64) []byte {
+				b[offsets[1]] ^= 0xff
+				return b
+			},
+			[]string{"a", "!", "c", "d"},
+		},
+		{
+			"length",
+			func(b []byte, offsets []int64) []byte {
+				b[offsets[1]+4] = 0xff
+				return b
+			},
+			[]string{"a", "!", "c", "d"},
+		},
+		{
+			"consecutive",
+			func(b []byte, offsets []int64) []byte {
+				b[offsets[1]+8] ^= 0xff
+				b[offsets[2]+8] ^= 0xff
+				return b
+			},
+			[]string{"a", "!", "d"},
+		},
+		{
+			"magic in data",
+			func(b []byte, offsets []int64) []byte {
+				b[offsets[1]+8] ^= 0xff
+				copy(b[offsets[2]-6:], binary.BigEndian.AppendUint32(nil, spillMagic))
+				return b
+			},
+			[]string{"a", "!", "c", "d"},
+		},
+		{
+			"torn write",
+			func(b []byte, offsets []int64) []byte {
+				return b[:offsets[3]+spillHeaderSize+2]
+			},
+			[]string{"a", "b", "c", "!"},
+		},
+		{
+			"torn header",
+			func(b []byte, offsets []int64) []byte {
+				return b[:offsets[3]+2]
+			},
+			[]string{"a", "b", "c", "!"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openSpill(t, dir)
+			offsets := spillEvents(t, s, "a", "b", "c", "d")
+			path := s.path(s.segments[0])
+			if err := s.close(); err != nil {
+				t.Fatalf("unable to close spill: %s", err)
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(path, tt.corrupt(b, offsets), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openSpill(t, dir)
+			if got := replayEvents(t, s, len(tt.want)); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+			checkSpillEmpty(t, s)
+		})
+	}
+}
@@ -2,8 +2,31 @@ package gateway
 
 import "github.com/spec-tacles/go/types"
 
-// UnknownSendPacket represents a packet to be sent with guild context for determining shard ID
+// UnknownSendPacket represents a packet to be sent with context for determining shard IDs
 type UnknownSendPacket struct {
-	GuildID uint64            `json:"guild_id,string"`
-	Packet  *types.SendPacket `json:"packet"`
+	GuildID   uint64            `json:"guild_id,string"`
+	ShardID   *int              `json:"shard_id,omitempty"`
+	Broadcast bool              `json:"broadcast,omitempty"`
+	Packet    *types.SendPacket `json:"packet"`
+
+	// ReplyTo is the event that GUILD_MEMBERS_CHUNK dispatches in response to a guild members
+	// request are published to, either as they arrive or combined into a GuildMembersResponse if
+	// Aggregate is set
+	ReplyTo   string `json:"reply_to,omitempty"`
+	Aggregate bool   `json:"aggregate,omitempty"`
+}
+
+// GatewayBot represents a GET /gateway/bot response
+type GatewayBot struct {
+	URL               string            `json:"url"`
+	Shards            int               `json:"shards"`
+	SessionStartLimit SessionStartLimit `json:"session_start_limit"`
+}
+
+// SessionStartLimit represents a GatewayBot's session start limit
+type SessionStartLimit struct {
+	Total          int `json:"total"`
+	Remaining      int `json:"remaining"`
+	ResetAfter     int `json:"reset_after"`
+	MaxConcurrency int `json:"max_concurrency"`
 }
@@ -1,11 +1,14 @@
 module github.com/spec-tacles/gateway
 
-go 1.21
+// golang.org/x/net v0.38.0, which was already required, needs go 1.23.0 or later
+go 1.23.0
+
 toolchain go1.24.1
 
 require (
 	github.com/BurntSushi/toml v1.3.2
 	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.18.0
 	github.com/mediocregopher/radix/v4 v4.1.4
 	github.com/prometheus/client_golang v1.19.1
 	github.com/spec-tacles/go v0.0.0-20240519052238-4bb677db055a
@@ -0,0 +1,73 @@
+// Package health exposes liveness and readiness endpoints for a running gateway
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/spec-tacles/gateway/gateway"
+)
+
+// Endpoints served by Handler
+const (
+	LivenessEndpoint  = "/healthz"
+	ReadinessEndpoint = "/readyz"
+)
+
+// Handler serves liveness and readiness checks for a manager
+type Handler struct {
+	Manager *gateway.Manager
+
+	// MinReady is the fraction of shards that must be healthy for the gateway to be ready
+	MinReady float64
+}
+
+// Status is the body of a health check response
+type Status struct {
+	Healthy int     `json:"healthy"`
+	Dead    int     `json:"dead"`
+	Total   int     `json:"total"`
+	Ready   float64 `json:"ready"`
+}
+
+// Register registers the health endpoints on the given mux
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessEndpoint, h.liveness)
+	mux.HandleFunc(ReadinessEndpoint, h.readiness)
+}
+
+// liveness fails once every shard is dead, since none of them will recover on their own
+func (h *Handler) liveness(w http.ResponseWriter, r *http.Request) {
+	status := h.status()
+
+	code := http.StatusOK
+	if status.Total > 0 && status.Dead == status.Total {
+		code = http.StatusServiceUnavailable
+	}
+	writeStatus(w, code, status)
+}
+
+// readiness fails until enough shards have a ready session and recent heartbeat ACKs
+func (h *Handler) readiness(w http.ResponseWriter, r *http.Request) {
+	status := h.status()
+
+	code := http.StatusOK
+	if status.Total == 0 || status.Ready < h.MinReady {
+		code = http.StatusServiceUnavailable
+	}
+	writeStatus(w, code, status)
+}
+
+func (h *Handler) status() (s Status) {
+	s.Healthy, s.Dead, s.Total = h.Manager.Health()
+	if s.Total > 0 {
+		s.Ready = float64(s.Healthy) / float64(s.Total)
+	}
+	return
+}
+
+func writeStatus(w http.ResponseWriter, code int, status Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
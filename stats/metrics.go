@@ -19,6 +19,34 @@ var (
 		Help:      "Counter of packets sent over all gateway connections.",
 	}, []string{"t", "op", "shard"})
 
+	// DispatchGaps is a counter of gaps in the sequence of dispatches received
+	DispatchGaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "dispatch_gaps",
+		Help:      "Counter of gaps in the sequence of dispatches received.",
+	}, []string{"shard"})
+
+	// DispatchesMissed is a counter of dispatches skipped by gaps in the sequence
+	DispatchesMissed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "dispatches_missed",
+		Help:      "Counter of dispatches skipped by gaps in the sequence of dispatches received.",
+	}, []string{"shard"})
+
+	// DuplicateDispatches is a counter of dispatches received more than once
+	DuplicateDispatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "duplicate_dispatches",
+		Help:      "Counter of dispatches received more than once in a session.",
+	}, []string{"shard"})
+
+	// OutOfOrderDispatches is a counter of dispatches received after a later dispatch
+	OutOfOrderDispatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "out_of_order_dispatches",
+		Help:      "Counter of dispatches received after a dispatch with a higher sequence.",
+	}, []string{"shard"})
+
 	// ShardsAlive is a gauge of the number of shards alive
 	ShardsAlive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "gateway",
@@ -33,6 +61,63 @@ var (
 		Help:      "Total number of shards that should be online.",
 	})
 
+	// SessionStartsRemaining is a gauge of the remaining daily session starts
+	SessionStartsRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "session_starts_remaining",
+		Help:      "Number of identifies remaining before the daily session start limit resets.",
+	})
+
+	// SessionStartsTotal is a gauge of the total daily session starts
+	SessionStartsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "session_starts_total",
+		Help:      "Total number of identifies allowed per session start limit period.",
+	})
+
+	// PublishQueueDepth is a gauge of the number of events waiting to be published
+	PublishQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "publish_queue_depth",
+		Help:      "Number of events waiting to be published to the broker.",
+	})
+
+	// PublishesDropped is a counter of events dropped from a full publish queue
+	PublishesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "publishes_dropped",
+		Help:      "Counter of events dropped because the publish queue or spill buffer was full.",
+	})
+
+	// PublishLatency is a histogram of the time taken to publish events
+	PublishLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "gateway",
+		Name:      "publish_latency_seconds",
+		Help:      "Time taken to publish an event to the broker.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	// SpillSize is a gauge of the size of the spill buffer
+	SpillSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "spill_size_bytes",
+		Help:      "Size of the events in the spill buffer waiting to be replayed.",
+	})
+
+	// EventsSpilled is a counter of events written to the spill buffer
+	EventsSpilled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "events_spilled",
+		Help:      "Counter of events written to the spill buffer.",
+	})
+
+	// EventsReplayed is a counter of events published from the spill buffer
+	EventsReplayed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "events_replayed",
+		Help:      "Counter of events published from the spill buffer.",
+	})
+
 	// Ping is a summary of shard heartbeat latency
 	Ping = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace: "gateway",
@@ -48,5 +133,23 @@ var (
 )
 
 func init() {
-	prometheus.MustRegister(PacketsReceived, PacketsSent, ShardsAlive, TotalShards, Ping)
+	prometheus.MustRegister(
+		PacketsReceived,
+		PacketsSent,
+		DispatchGaps,
+		DispatchesMissed,
+		DuplicateDispatches,
+		OutOfOrderDispatches,
+		ShardsAlive,
+		TotalShards,
+		SessionStartsRemaining,
+		SessionStartsTotal,
+		PublishQueueDepth,
+		PublishesDropped,
+		PublishLatency,
+		SpillSize,
+		EventsSpilled,
+		EventsReplayed,
+		Ping,
+	)
 }